@@ -4,13 +4,98 @@
 package sshkrb5
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/keytab"
 	"github.com/openshift/gssapi"
 )
 
+const (
+	backend = "apcera"
+
+	// MIT Kerberos minor status codes for KRB-ERROR codes are offset from
+	// the base of its error table
+	krb5ErrorTableBase = -1765328384
+
+	krb5CCName = "KRB5CCNAME"
+
+	// gssDelegPolicyFlag is GSS_C_DELEG_POLICY_FLAG, an MIT extension that
+	// only delegates if the service ticket is ok-as-delegate
+	gssDelegPolicyFlag uint32 = 0x8000
+)
+
+var (
+	errWrongPrincipal = errors.New("security context is not for a service principal")
+	errCCacheInUse    = errors.New("KRB5CCNAME is set to a different credentials cache by another Client")
+)
+
+// ccacheEnv tracks KRB5CCNAME while it's set by one or more Clients.
+var ccacheEnv struct { //nolint:gochecknoglobals
+	sync.Mutex
+	name     string
+	refs     int
+	previous string
+	restore  bool
+}
+
+// setCCacheEnv sets KRB5CCNAME to name, unless it's already set to a
+// different value by another Client.
+func setCCacheEnv(name string) error {
+	ccacheEnv.Lock()
+	defer ccacheEnv.Unlock()
+
+	if ccacheEnv.refs > 0 {
+		if ccacheEnv.name != name {
+			return fmt.Errorf("%w: %s", errCCacheInUse, ccacheEnv.name)
+		}
+
+		ccacheEnv.refs++
+
+		return nil
+	}
+
+	previous, restore := os.LookupEnv(krb5CCName)
+
+	if err := os.Setenv(krb5CCName, name); err != nil {
+		return err
+	}
+
+	ccacheEnv.name, ccacheEnv.refs = name, 1
+	ccacheEnv.previous, ccacheEnv.restore = previous, restore
+
+	return nil
+}
+
+// unsetCCacheEnv restores KRB5CCNAME to its previous value once no Client
+// needs it.
+func unsetCCacheEnv() error {
+	ccacheEnv.Lock()
+	defer ccacheEnv.Unlock()
+
+	ccacheEnv.refs--
+
+	if ccacheEnv.refs > 0 {
+		return nil
+	}
+
+	if ccacheEnv.restore {
+		return os.Setenv(krb5CCName, ccacheEnv.previous)
+	}
+
+	return os.Unsetenv(krb5CCName)
+}
+
 // WithConfig sets the configuration in the Client.
 func WithConfig[T Client](_ string) Option[T] {
 	return unsupportedOption[T]
@@ -36,16 +121,147 @@ func WithKeytab[T Client | Server](_ string) Option[T] {
 	return unsupportedOption[T]
 }
 
+// WithKeytabBytes sets the keytab contents in either a Client or Server.
+func WithKeytabBytes[T Client | Server](_ []byte) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithParsedKeytab sets the keytab in either a Client or Server.
+func WithParsedKeytab[T Client | Server](_ *keytab.Keytab) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithClockSkew sets the maximum permitted clock skew in either a Client or
+// Server.
+func WithClockSkew[T Client | Server](_ time.Duration) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithClock sets the source of the current time in either a Client or
+// Server.
+func WithClock[T Client | Server](_ func() time.Time) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithReplayCache sets the ReplayCache in the Server.
+func WithReplayCache[T Server](_ ReplayCache) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithKeytabValidation sets whether NewServer checks that acceptor
+// credentials can be acquired for the service principals, which is the
+// default. Disabling it allows the keytab to be provisioned after the Server
+// is created.
+func WithKeytabValidation[T Server](validate bool) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.validate = validate
+		}
+
+		return nil
+	}
+}
+
+// WithWeakKeys sets whether NewServer accepts a keytab that only has weak
+// keys. The permitted encryption types are configured in krb5.conf so this
+// has no effect.
+func WithWeakKeys[T Server](_ bool) Option[T] {
+	return func(*T) error {
+		return nil
+	}
+}
+
+// WithCCache sets the credentials cache in the Client rather than using the
+// default. The library only reads the credentials cache name from the
+// environment so this sets KRB5CCNAME for the whole process until the Client
+// is closed, when the previous value is restored. NewClient fails if another
+// Client has already set it to a different credentials cache.
+func WithCCache[T Client](name string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.ccache = name
+			x.ccacheData = nil
+		}
+
+		return nil
+	}
+}
+
+// WithCCacheBytes sets the credentials cache contents in the Client. They
+// are written to a private file that is used as with WithCCache and
+// destroyed when the Client is closed. As the file is private only one such
+// Client can exist at a time.
+func WithCCacheBytes[T Client](b []byte) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.ccache = ""
+			x.ccacheData = b
+		}
+
+		return nil
+	}
+}
+
+// WithCCachePrincipal sets the principal in the Client, in the form
+// user@REALM or just user for the default realm, whose credentials are used
+// from a collection.
+func WithCCachePrincipal[T Client](principal string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.ccachePrincipal = principal
+		}
+
+		return nil
+	}
+}
+
+// WithStoreCCache sets a credentials cache file in the Client that tickets
+// are stored in.
+func WithStoreCCache[T Client](_ string) Option[T] {
+	return unsupportedOption[T]
+}
+
 // Client implements the ssh.GSSAPIClient interface.
+//
+// The ssh.GSSAPIClient methods on Client share a single security context so
+// a Client used directly can only safely make one connection at a time. Use
+// NewContext to create an isolated ClientContext for each connection, which
+// all share the credentials of the Client.
 type Client struct {
+	ccache          string
+	ccacheData      []byte
+	ccacheFile      *CCacheFile
+	ccachePrincipal string
+	// ccacheEnvSet is whether the Client has set KRB5CCNAME
+	ccacheEnvSet bool
+
 	lib *gssapi.Lib
-	ctx *gssapi.CtxId
+	// cred is shared by every security context, the library locks it
+	// internally
+	cred *gssapi.CredId
+
+	canonicalizer
+
+	// exchanges tracks calls that may still be waiting for the KDC after
+	// being abandoned
+	exchanges sync.WaitGroup
+	// serverIdentity overrides the target if set
+	serverIdentity string
+	delegation     DelegationPolicy
+
+	defaultContext *ClientContext
 
 	logger logr.Logger
 }
 
-// NewClient returns a new Client using the current user.
-func NewClient(options ...Option[Client]) (*Client, error) {
+// NewClientContext returns a new Client using the current user. The
+// credentials are acquired without contacting the KDC so ctx is only checked
+// before starting.
+func NewClientContext(ctx context.Context, options ...Option[Client]) (*Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errAbandoned, err)
+	}
+
 	c := &Client{
 		logger: logr.Discard(),
 	}
@@ -58,40 +274,246 @@ func NewClient(options ...Option[Client]) (*Client, error) {
 		}
 	}
 
+	if c.ccacheData != nil {
+		if c.ccacheFile, err = writeCCacheFile(c.ccacheData, c.logger); err != nil {
+			return nil, err
+		}
+
+		c.ccache = c.ccacheFile.Name()
+	}
+
+	if c.ccache != "" {
+		if err = setCCacheEnv(c.ccache); err != nil {
+			return nil, multierror.Append(err, c.releaseCCache()).ErrorOrNil()
+		}
+
+		c.ccacheEnvSet = true
+	}
+
 	c.lib, err = gssapi.Load(nil)
+	if err != nil {
+		return nil, multierror.Append(err, c.releaseCCache()).ErrorOrNil()
+	}
+
+	if c.ccachePrincipal != "" {
+		if c.cred, err = c.acquireCred(); err != nil {
+			return nil, multierror.Append(err, c.lib.Unload(), c.releaseCCache()).ErrorOrNil()
+		}
+	}
+
+	c.defaultContext = c.NewContext()
+
+	return c, nil
+}
+
+// NewContext returns a new ClientContext that shares the credentials of the
+// Client but has its own security context.
+func (c *Client) NewContext() *ClientContext {
+	return &ClientContext{
+		client:       c,
+		handshakeCtx: context.Background(),
+	}
+}
+
+// writeCCacheFile writes the credentials cache contents to a private file.
+func writeCCacheFile(b []byte, logger logr.Logger) (*CCacheFile, error) {
+	file, err := os.CreateTemp("", "krb5cc_")
+	if err != nil {
+		return nil, err
+	}
+
+	ccache := &CCacheFile{
+		path:   file.Name(),
+		logger: logger,
+	}
+
+	_, err = file.Write(b)
+	if err = multierror.Append(err, file.Close()).ErrorOrNil(); err != nil {
+		return nil, multierror.Append(err, ccache.Destroy())
+	}
+
+	return ccache, nil
+}
+
+// acquireCred acquires the initiator credentials for the principal, which
+// selects the credentials cache from a collection.
+func (c *Client) acquireCred() (cred *gssapi.CredId, err error) {
+	buffer, err := c.lib.MakeBufferString(c.ccachePrincipal)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err = multierror.Append(err, buffer.Release()).ErrorOrNil()
+	}()
+
+	principal, err := buffer.Name(c.lib.GSS_KRB5_NT_PRINCIPAL_NAME)
+	if err != nil {
+		return nil, err
+	}
 
-	return c, err
+	defer func() {
+		err = multierror.Append(err, principal.Release()).ErrorOrNil()
+	}()
+
+	oids, err := c.lib.MakeOIDSet(c.lib.GSS_MECH_KRB5)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err = multierror.Append(err, oids.Release()).ErrorOrNil()
+	}()
+
+	cred, _, _, err = c.lib.AcquireCred(principal, gssapi.GSS_C_INDEFINITE, oids, gssapi.GSS_C_INITIATE)
+
+	return cred, err
 }
 
 // Close deletes any active security context and unloads any underlying
 // libraries as necessary.
 func (c *Client) Close() error {
-	return multierror.Append(c.DeleteSecContext(), c.lib.Unload()).ErrorOrNil()
+	c.exchanges.Wait()
+
+	err := c.DeleteSecContext()
+
+	if c.cred != nil {
+		err = multierror.Append(err, c.cred.Release()).ErrorOrNil()
+	}
+
+	return multierror.Append(err, c.lib.Unload(), c.releaseCCache()).ErrorOrNil()
+}
+
+// releaseCCache restores KRB5CCNAME if it was set and destroys any private
+// credentials cache file.
+func (c *Client) releaseCCache() (err error) {
+	if c.ccacheEnvSet {
+		err = multierror.Append(err, unsetCCacheEnv()).ErrorOrNil()
+		c.ccacheEnvSet = false
+	}
+
+	if c.ccacheFile != nil {
+		err = multierror.Append(err, c.ccacheFile.Destroy()).ErrorOrNil()
+	}
+
+	return err
 }
 
 // InitSecContext is called by the ssh.Client to initialise or advance the
 // security context.
-//
-//nolint:funlen
 func (c *Client) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
-	var (
-		buffer  *gssapi.Buffer
-		service *gssapi.Name
-		err     error
-	)
+	return c.defaultContext.InitSecContext(target, token, isGSSDelegCreds)
+}
+
+// GetMIC is called by the ssh.Client to authenticate the user using the
+// negotiated security context.
+func (c *Client) GetMIC(micField []byte) ([]byte, error) {
+	return c.defaultContext.GetMIC(micField)
+}
+
+// DeleteSecContext is called by the ssh.Client to tear down any active
+// security context.
+func (c *Client) DeleteSecContext() error {
+	return c.defaultContext.DeleteSecContext()
+}
+
+// ClientContext implements the ssh.GSSAPIClient interface for a single
+// connection.
+type ClientContext struct {
+	client       *Client
+	handshakeCtx context.Context //nolint:containedctx
+	// target is the canonicalised target
+	target string
+
+	// lib is loaded for each security context as it records the status of
+	// the last call in shared state, so handshakes don't have to be
+	// serialised while waiting for the KDC
+	lib *gssapi.Lib
+	ctx *gssapi.CtxId
+}
+
+// InitSecContext is called by the ssh.Client to initialise or advance the
+// security context.
+func (c *ClientContext) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	if len(token) == 0 || c.target == "" {
+		if c.client.serverIdentity != "" {
+			c.target = c.client.serverIdentity
+		} else {
+			c.target = c.client.canonicalTarget(c.handshakeCtx, target, c.client.logger)
+		}
+	}
+
+	target = c.target
 
-	buffer, err = c.lib.MakeBufferString(target)
+	if len(token) > 0 {
+		if c.lib == nil {
+			return nil, false, errNoContext
+		}
+
+		ctx, output, cont, err := c.initSecContext(c.lib, c.ctx, target, token, isGSSDelegCreds)
+		if err != nil {
+			return nil, false, err
+		}
+
+		c.ctx = ctx
+
+		return output, cont, nil
+	}
+
+	if err := c.DeleteSecContext(); err != nil {
+		return nil, false, err
+	}
+
+	type result struct {
+		lib    *gssapi.Lib
+		ctx    *gssapi.CtxId
+		output []byte
+		cont   bool
+	}
+
+	// Creating the security context requests the service ticket from the
+	// KDC, any context created after giving up is deleted
+	r, err := withContext(c.handshakeCtx, &c.client.exchanges, func() (result, error) {
+		lib, err := gssapi.Load(nil)
+		if err != nil {
+			return result{}, err
+		}
+
+		ctx, output, cont, err := c.initSecContext(lib, nil, target, token, isGSSDelegCreds)
+		if err != nil {
+			return result{}, multierror.Append(err, lib.Unload()).ErrorOrNil()
+		}
+
+		return result{lib, ctx, output, cont}, nil
+	}, func(r result) {
+		_ = multierror.Append(r.ctx.DeleteSecContext(), r.lib.Unload())
+	})
 	if err != nil {
 		return nil, false, err
 	}
 
+	c.lib, c.ctx = r.lib, r.ctx
+
+	return r.output, r.cont, nil
+}
+
+// initSecContext initialises or advances ctx using lib, a nil ctx creates a
+// new security context.
+//
+//nolint:funlen,lll
+func (c *ClientContext) initSecContext(lib *gssapi.Lib, ctx *gssapi.CtxId, target string, token []byte, isGSSDelegCreds bool) (_ *gssapi.CtxId, _ []byte, _ bool, err error) {
+	buffer, err := lib.MakeBufferString(target)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
 	defer func() {
 		err = multierror.Append(err, buffer.Release()).ErrorOrNil()
 	}()
 
-	service, err = buffer.Name(c.lib.GSS_C_NT_HOSTBASED_SERVICE)
+	service, err := buffer.Name(lib.GSS_C_NT_HOSTBASED_SERVICE)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, false, err
 	}
 
 	defer func() {
@@ -99,58 +521,72 @@ func (c *Client) InitSecContext(target string, token []byte, isGSSDelegCreds boo
 	}()
 
 	gssapiFlags := uint32(gssapi.GSS_C_MUTUAL_FLAG | gssapi.GSS_C_INTEG_FLAG)
-	if isGSSDelegCreds {
+	if c.client.delegation.delegate(isGSSDelegCreds) {
 		gssapiFlags |= gssapi.GSS_C_DELEG_FLAG
+		if c.client.delegation == DelegateOKAsDelegate {
+			gssapiFlags |= gssDelegPolicyFlag
+		}
 	}
 
 	var input *gssapi.Buffer
 
-	switch len(token) {
-	default:
-		input, err = c.lib.MakeBufferBytes(token)
+	if len(token) > 0 {
+		input, err = lib.MakeBufferBytes(token)
 		if err != nil {
-			return nil, false, err
+			return nil, nil, false, err
 		}
 
 		defer func() {
 			err = multierror.Append(err, input.Release()).ErrorOrNil()
 		}()
+	}
 
-		fallthrough
-	case 0:
-		var (
-			ctx    *gssapi.CtxId
-			output *gssapi.Buffer
-		)
+	cred := lib.GSS_C_NO_CREDENTIAL
+	if c.client.cred != nil {
+		cred = c.client.cred
+	}
 
-		//nolint:lll
-		ctx, _, output, _, _, err = c.lib.InitSecContext(c.lib.GSS_C_NO_CREDENTIAL, c.ctx, service, c.lib.GSS_MECH_KRB5, gssapiFlags, 0, c.lib.GSS_C_NO_CHANNEL_BINDINGS, input)
-		if err != nil && !errors.Is(err, gssapi.ErrContinueNeeded) {
-			return nil, false, err
-		}
+	var (
+		output   *gssapi.Buffer
+		retFlags uint32
+	)
 
-		if errors.Is(err, gssapi.ErrContinueNeeded) {
-			err = nil
-		}
+	ctx, _, output, retFlags, _, err = lib.InitSecContext(cred, ctx, service, lib.GSS_MECH_KRB5, gssapiFlags, 0, lib.GSS_C_NO_CHANNEL_BINDINGS, input)
 
-		defer func() {
-			err = multierror.Append(err, output.Release()).ErrorOrNil()
-		}()
+	// The library reports that another token is needed as an error
+	cont := errors.Is(err, gssapi.ErrContinueNeeded)
+	if err != nil && !cont {
+		return nil, nil, false, err
+	}
 
-		c.ctx = ctx
+	err = nil
+
+	defer func() {
+		err = multierror.Append(err, output.Release()).ErrorOrNil()
+	}()
 
-		return output.Bytes(), c.lib.LastStatus.Major.ContinueNeeded(), err
+	// The library silently skips delegation if the TGT isn't forwardable
+	// or the service ticket isn't ok-as-delegate
+	if !cont && gssapiFlags&gssapi.GSS_C_DELEG_FLAG != 0 && retFlags&gssapi.GSS_C_DELEG_FLAG == 0 {
+		c.client.logger.Info("credentials weren't delegated, the TGT may not be forwardable or the service ticket "+
+			"isn't ok-as-delegate", "target", target)
 	}
+
+	return ctx, output.Bytes(), cont, err
 }
 
 // GetMIC is called by the ssh.Client to authenticate the user using the
 // negotiated security context.
-func (c *Client) GetMIC(micField []byte) ([]byte, error) {
+func (c *ClientContext) GetMIC(micField []byte) ([]byte, error) {
 	var (
 		message, token *gssapi.Buffer
 		err            error
 	)
 
+	if c.lib == nil {
+		return nil, errNoContext
+	}
+
 	message, err = c.lib.MakeBufferBytes(micField)
 	if err != nil {
 		return nil, err
@@ -174,19 +610,38 @@ func (c *Client) GetMIC(micField []byte) ([]byte, error) {
 
 // DeleteSecContext is called by the ssh.Client to tear down any active
 // security context.
-func (c *Client) DeleteSecContext() error {
-	err := c.ctx.DeleteSecContext()
-	c.ctx = c.lib.GSS_C_NO_CONTEXT
+func (c *ClientContext) DeleteSecContext() error {
+	if c.lib == nil {
+		return nil
+	}
+
+	err := multierror.Append(c.ctx.DeleteSecContext(), c.lib.Unload()).ErrorOrNil()
+	c.lib, c.ctx = nil, nil
 
 	return err
 }
 
 // Server implements the ssh.GSSAPIServer interface.
+//
+// The ssh.GSSAPIServer methods on Server share a single security context so
+// a Server used directly can only safely handle one connection at a time.
+// Use NewContext to create an isolated ServerContext for each connection.
 type Server struct {
-	strict bool
+	strict     bool
+	principals []string
+	validate   bool
 
 	lib *gssapi.Lib
-	ctx *gssapi.CtxId
+	// mu serialises calls into lib as it records the status of the last
+	// call in shared state
+	mu  sync.Mutex
+	now func() time.Time
+
+	policy    policy
+	auditHook func(AuditEvent)
+	throttle  throttle
+
+	defaultContext *ServerContext
 
 	logger logr.Logger
 }
@@ -194,8 +649,10 @@ type Server struct {
 // NewServer returns a new Server.
 func NewServer(options ...Option[Server]) (*Server, error) {
 	s := &Server{
-		strict: true,
-		logger: logr.Discard(),
+		strict:   true,
+		validate: true,
+		now:      time.Now,
+		logger:   logr.Discard(),
 	}
 
 	var err error
@@ -206,72 +663,235 @@ func NewServer(options ...Option[Server]) (*Server, error) {
 		}
 	}
 
+	if s.strict && len(s.principals) == 0 {
+		hostname, err := osHostname()
+		if err != nil {
+			return nil, err
+		}
+
+		s.principals = []string{"host/" + hostname}
+	}
+
 	s.lib, err = gssapi.Load(nil)
+	if err != nil {
+		return nil, err
+	}
 
-	return s, err
+	if s.validate {
+		if err = s.validateKeytab(); err != nil {
+			return nil, multierror.Append(err, s.lib.Unload()).ErrorOrNil()
+		}
+	}
+
+	s.defaultContext = s.NewContext()
+
+	return s, nil
+}
+
+// NewContext returns a new ServerContext that shares the configuration of
+// the Server but has its own security context.
+func (s *Server) NewContext() *ServerContext {
+	return &ServerContext{
+		server: s,
+		ctx:    s.lib.GSS_C_NO_CONTEXT,
+	}
 }
 
 // Close deletes any active security context and unloads any underlying
 // libraries as necessary.
 func (s *Server) Close() error {
-	return multierror.Append(s.DeleteSecContext(), s.lib.Unload())
+	return multierror.Append(s.DeleteSecContext(), s.lib.Unload()).ErrorOrNil()
 }
 
 // AcceptSecContext is called by the ssh.ServerConn to accept and advance the
 // security context.
-//
-//nolint:cyclop,funlen
 func (s *Server) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
-	var (
-		cred          *gssapi.CredId
-		input, output *gssapi.Buffer
-		name          *gssapi.Name
-		ctx           *gssapi.CtxId
-		err           error
-	)
+	return s.defaultContext.AcceptSecContext(token)
+}
+
+// backendAuditReason returns the reason for a GSSAPI error, using the
+// Kerberos error where the minor status is one.
+func backendAuditReason(err error) AuditReason {
+	var gssError *gssapi.Error
+	if !errors.As(err, &gssError) {
+		if errors.Is(err, errWrongPrincipal) {
+			return ReasonWrongPrincipal
+		}
+
+		return ReasonOther
+	}
+
+	switch int32(gssError.Minor) - krb5ErrorTableBase { //nolint:gosec
+	case errorcode.KRB_AP_ERR_NOT_US:
+		return ReasonWrongPrincipal
+	case errorcode.KRB_AP_ERR_NOKEY, errorcode.KRB_AP_ERR_BADKEYVER:
+		return ReasonUnknownKVNO
+	case errorcode.KRB_AP_ERR_BAD_INTEGRITY, errorcode.KRB_AP_ERR_BADMATCH:
+		return ReasonBadIntegrity
+	case errorcode.KRB_AP_ERR_TKT_NYV:
+		return ReasonTicketNotYetValid
+	case errorcode.KRB_AP_ERR_TKT_EXPIRED:
+		return ReasonTicketExpired
+	case errorcode.KRB_AP_ERR_SKEW:
+		return ReasonClockSkew
+	case errorcode.KRB_AP_ERR_REPEAT:
+		return ReasonReplay
+	}
+
+	switch gssError.Major.RoutineError() {
+	case gssapi.GSS_S_DEFECTIVE_TOKEN:
+		return ReasonMalformedToken
+	case gssapi.GSS_S_CREDENTIALS_EXPIRED, gssapi.GSS_S_CONTEXT_EXPIRED:
+		return ReasonTicketExpired
+	}
+
+	return ReasonOther
+}
+
+// VerifyMIC is called by the ssh.ServerConn to authenticate the user using
+// the negotiated security context.
+func (s *Server) VerifyMIC(micField, micToken []byte) error {
+	return s.defaultContext.VerifyMIC(micField, micToken)
+}
+
+// DeleteSecContext is called by the ssh.ServerConn to tear down any active
+// security context.
+func (s *Server) DeleteSecContext() error {
+	return s.defaultContext.DeleteSecContext()
+}
+
+// ServerContext implements the ssh.GSSAPIServer interface for a single
+// connection.
+type ServerContext struct {
+	server *Server
+
+	ctx              *gssapi.CtxId
+	servicePrincipal string
+	peerInfo         *PeerInfo
+
+	remoteAddr net.Addr
+}
+
+// acquireCred acquires the acceptor credentials for the service principal,
+// which is the equivalent of GSSAPIStrictAcceptorCheck.
+func (s *Server) acquireCred(principal string) (cred *gssapi.CredId, err error) {
+	buffer, err := s.lib.MakeBufferString(strings.Replace(principal, "/", "@", 1))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err = multierror.Append(err, buffer.Release()).ErrorOrNil()
+	}()
+
+	service, err := buffer.Name(s.lib.GSS_C_NT_HOSTBASED_SERVICE)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err = multierror.Append(err, service.Release()).ErrorOrNil()
+	}()
+
+	oids, err := s.lib.MakeOIDSet(s.lib.GSS_MECH_KRB5)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err = multierror.Append(err, oids.Release()).ErrorOrNil()
+	}()
+
+	cred, _, _, err = s.lib.AcquireCred(service, gssapi.GSS_C_INDEFINITE, oids, gssapi.GSS_C_ACCEPT)
 
-	// equivalent of GSSAPIStrictAcceptorCheck
-	if s.strict { //nolint:nestif
-		var (
-			hostname string
-			buffer   *gssapi.Buffer
-			service  *gssapi.Name
-			oids     *gssapi.OIDSet
-		)
+	return cred, err
+}
 
-		hostname, err = osHostname()
+// validateKeytab checks acceptor credentials can be acquired for every
+// service principal, which requires a key for each in the keytab. Without
+// any service principals there is nothing to check.
+func (s *Server) validateKeytab() error {
+	for _, principal := range s.principals {
+		cred, err := s.acquireCred(principal)
 		if err != nil {
-			return nil, "", false, err
+			return &KeytabError{Principal: principal, Err: fmt.Errorf("%w: %w", ErrNoKey, err)}
 		}
 
-		buffer, err = s.lib.MakeBufferString("host@" + hostname)
-		if err != nil {
-			return nil, "", false, err
+		if err := cred.Release(); err != nil {
+			return err
 		}
+	}
 
-		defer func() {
-			err = multierror.Append(err, buffer.Release()).ErrorOrNil()
-		}()
+	return nil
+}
 
-		service, err = buffer.Name(s.lib.GSS_C_NT_HOSTBASED_SERVICE)
-		if err != nil {
-			return nil, "", false, err
+// checkTarget checks the established security context was for one of the
+// service principals or, if there are none, any host-based service principal
+// which is the equivalent of GSSAPIStrictAcceptorCheck=no. It returns the
+// service principal.
+func (s *Server) checkTarget(ctx *gssapi.CtxId) (_ string, err error) {
+	//nolint:dogsled
+	source, target, _, _, _, _, _, err := ctx.InquireContext()
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		err = multierror.Append(err, source.Release(), target.Release()).ErrorOrNil()
+	}()
+
+	principal := target.String()
+	name, _, _ := strings.Cut(principal, "@")
+
+	if len(s.principals) == 0 {
+		if service, hostname, ok := strings.Cut(name, "/"); ok && service == "host" && !strings.Contains(hostname, "/") {
+			return principal, nil
 		}
+	}
 
-		defer func() {
-			err = multierror.Append(err, service.Release()).ErrorOrNil()
-		}()
+	for _, p := range s.principals {
+		if name == p {
+			return principal, nil
+		}
+	}
 
-		oids, err = s.lib.MakeOIDSet(s.lib.GSS_MECH_KRB5)
-		if err != nil {
-			return nil, "", false, err
+	return "", fmt.Errorf("%w: %s", errWrongPrincipal, principal)
+}
+
+// AcceptSecContext is called by the ssh.ServerConn to accept and advance the
+// security context.
+//
+//nolint:cyclop,funlen
+func (c *ServerContext) AcceptSecContext(token []byte) (_ []byte, principal string, cont bool, err error) {
+	defer func(start time.Time) {
+		if err == nil && cont {
+			return
 		}
 
-		defer func() {
-			err = multierror.Append(err, oids.Release()).ErrorOrNil()
-		}()
+		c.server.audit(AuditEvent{
+			Stage:            AuditAcceptSecContext,
+			Principal:        principal,
+			RemoteAddr:       c.remoteAddr,
+			ServicePrincipal: c.servicePrincipal,
+			Time:             start,
+			Err:              err,
+		})
+	}(time.Now())
+
+	if err = c.server.throttle.check("", c.remoteAddr, c.server.now()); err != nil {
+		return nil, "", false, err
+	}
 
-		cred, _, _, err = s.lib.AcquireCred(service, gssapi.GSS_C_INDEFINITE, oids, gssapi.GSS_C_ACCEPT)
+	lib := c.server.lib
+
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	// A credential can only hold one name so any other case is checked
+	// once the security context is established
+	cred := lib.GSS_C_NO_CREDENTIAL
+	if len(c.server.principals) == 1 {
+		cred, err = c.server.acquireCred(c.server.principals[0])
 		if err != nil {
 			return nil, "", false, err
 		}
@@ -279,11 +899,9 @@ func (s *Server) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
 		defer func() {
 			err = multierror.Append(err, cred.Release()).ErrorOrNil()
 		}()
-	} else {
-		cred = s.lib.GSS_C_NO_CREDENTIAL
 	}
 
-	input, err = s.lib.MakeBufferBytes(token)
+	input, err := lib.MakeBufferBytes(token)
 	if err != nil {
 		return nil, "", false, err
 	}
@@ -292,56 +910,138 @@ func (s *Server) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
 		err = multierror.Append(err, input.Release()).ErrorOrNil()
 	}()
 
-	//nolint:dogsled
-	ctx, name, _, output, _, _, _, err = s.lib.AcceptSecContext(s.ctx, cred, input, s.lib.GSS_C_NO_CHANNEL_BINDINGS)
+	ctx, name, _, output, flags, lifetime, delegated, err := lib.AcceptSecContext(c.ctx, cred, input, lib.GSS_C_NO_CHANNEL_BINDINGS)
 	if err != nil && !errors.Is(err, gssapi.ErrContinueNeeded) {
 		return nil, "", false, err
 	}
 
-	if errors.Is(err, gssapi.ErrContinueNeeded) {
+	cont = errors.Is(err, gssapi.ErrContinueNeeded)
+	if cont {
 		err = nil
 	}
 
 	defer func() {
-		err = multierror.Append(err, name.Release(), output.Release()).ErrorOrNil()
+		err = multierror.Append(err, name.Release(), output.Release(), delegated.Release()).ErrorOrNil()
 	}()
 
-	s.ctx = ctx
+	c.ctx = ctx
+	c.servicePrincipal = ""
+	c.peerInfo = nil
+
+	if !cont {
+		if err = c.server.throttle.check(name.String(), nil, c.server.now()); err == nil {
+			c.servicePrincipal, err = c.server.checkTarget(ctx)
+		}
+
+		// Return the principal so the failure is recorded against it
+		if err != nil {
+			err = multierror.Append(err, c.ctx.DeleteSecContext()).ErrorOrNil()
+			c.ctx = lib.GSS_C_NO_CONTEXT
+
+			return nil, name.String(), false, err
+		}
+
+		c.server.logger.Info("accepted service principal", "principal", name.String(), "service", c.servicePrincipal)
+
+		// Only the principal, expiry and delegation are available
+		c.peerInfo = newPeerInfo(name.String())
+		c.peerInfo.EndTime = c.server.now().Add(lifetime)
+		c.peerInfo.Delegated = flags&gssapi.GSS_C_DELEG_FLAG != 0
+	}
 
-	return output.Bytes(), name.String(), s.lib.LastStatus.Major.ContinueNeeded(), err
+	return output.Bytes(), name.String(), cont, err
 }
 
 // VerifyMIC is called by the ssh.ServerConn to authenticate the user using
 // the negotiated security context.
-func (s *Server) VerifyMIC(micField, micToken []byte) (err error) {
-	message, err := s.lib.MakeBufferBytes(micField)
+func (c *ServerContext) VerifyMIC(micField, micToken []byte) (err error) {
+	defer func(start time.Time) {
+		var principal string
+		if c.peerInfo != nil {
+			principal = c.peerInfo.Principal
+		}
+
+		c.server.audit(AuditEvent{
+			Stage:            AuditVerifyMIC,
+			Principal:        principal,
+			RemoteAddr:       c.remoteAddr,
+			ServicePrincipal: c.servicePrincipal,
+			Time:             start,
+			Err:              err,
+		})
+	}(time.Now())
+
+	lib := c.server.lib
+
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	message, err := lib.MakeBufferBytes(micField)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	defer func() {
 		err = multierror.Append(err, message.Release()).ErrorOrNil()
 	}()
 
-	token, err := s.lib.MakeBufferBytes(micToken)
+	token, err := lib.MakeBufferBytes(micToken)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	defer func() {
 		err = multierror.Append(err, token.Release()).ErrorOrNil()
 	}()
 
-	_, err = s.ctx.VerifyMIC(message, token)
+	_, err = c.ctx.VerifyMIC(message, token)
 
 	return err
 }
 
 // DeleteSecContext is called by the ssh.ServerConn to tear down any active
 // security context.
-func (s *Server) DeleteSecContext() error {
-	err := s.ctx.DeleteSecContext()
-	s.ctx = s.lib.GSS_C_NO_CONTEXT
+func (c *ServerContext) DeleteSecContext() error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	err := c.ctx.DeleteSecContext()
+	c.ctx = c.server.lib.GSS_C_NO_CONTEXT
 
 	return err
 }
+
+// DelegatedCredentials returns any credentials delegated by the client once
+// the security context has been established. This is not supported.
+func (c *ServerContext) DelegatedCredentials() (*credentials.CCache, error) {
+	return nil, errNotSupported
+}
+
+// PeerInfo returns details of the principal authenticated by the security
+// context once it has been established. Only the principal, EndTime and
+// Delegated fields are populated.
+func (c *ServerContext) PeerInfo() (*PeerInfo, error) {
+	if c.peerInfo == nil {
+		return nil, errNoContext
+	}
+
+	return c.peerInfo, nil
+}
+
+// ServicePrincipal returns the service principal the client authenticated
+// against once the security context has been established. In strict mode
+// this is one of the configured principals, otherwise it can be any host-based
+// service principal in the keytab.
+func (c *ServerContext) ServicePrincipal() (string, error) {
+	if c.servicePrincipal == "" {
+		return "", errNoContext
+	}
+
+	return c.servicePrincipal, nil
+}
+
+// WriteDelegatedCredentials writes any credentials delegated by the client to
+// a new private file credentials cache. This is not supported.
+func (c *ServerContext) WriteDelegatedCredentials(_ string) (*CCacheFile, error) {
+	return nil, errNotSupported
+}
@@ -4,6 +4,7 @@
 package sshkrb5_test
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/bodgit/sshkrb5"
@@ -21,6 +22,41 @@ func TestNewClient(t *testing.T) {
 	assert.Regexp(t, `\btest$`, whoami)
 }
 
+func TestClientConcurrentContexts(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	//nolint:dogsled
+	hostname, port, _, username, _, _ := testEnvironmentVariables(t)
+
+	client, err := sshkrb5.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		assert.NoError(t, client.Close())
+	}()
+
+	// Each context loads its own handle on the library so the handshakes
+	// can run concurrently without racing on its recorded status
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Go(func() {
+			whoami, err := testConnectionWhoami(client.NewContext(), hostname, port, username)
+			if assert.NoError(t, err) {
+				assert.Regexp(t, `\btest$`, whoami)
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
 func TestNewClientWithCredentials(t *testing.T) {
 	t.Parallel()
 	_, err := testNewClientWithCredentials(t)
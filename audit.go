@@ -0,0 +1,170 @@
+package sshkrb5
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuditStage is the step of a GSSAPI authentication described by an
+// AuditEvent.
+type AuditStage string
+
+const (
+	// AuditAcceptSecContext is when the security context is established
+	// or fails to be.
+	AuditAcceptSecContext AuditStage = "accept"
+	// AuditVerifyMIC is when the MIC is verified.
+	AuditVerifyMIC AuditStage = "verify_mic"
+	// AuditAllowLogin is when the principal is allowed or denied logging
+	// in as the SSH user by AllowLogin.
+	AuditAllowLogin AuditStage = "allow_login"
+)
+
+// AuditReason categorises why a step of a GSSAPI authentication failed.
+type AuditReason string
+
+const (
+	// ReasonNone is used when the step succeeded.
+	ReasonNone AuditReason = ""
+	// ReasonMalformedToken is used when the token couldn't be decoded.
+	ReasonMalformedToken AuditReason = "malformed_token"
+	// ReasonWrongPrincipal is used when the ticket is for a service
+	// principal that isn't accepted.
+	ReasonWrongPrincipal AuditReason = "wrong_service_principal"
+	// ReasonUnknownKVNO is used when the keytab has no key for the ticket.
+	ReasonUnknownKVNO AuditReason = "unknown_kvno"
+	// ReasonBadIntegrity is used when the ticket or authenticator couldn't
+	// be decrypted or don't match.
+	ReasonBadIntegrity AuditReason = "bad_integrity"
+	// ReasonTicketNotYetValid is used when the ticket isn't valid yet.
+	ReasonTicketNotYetValid AuditReason = "ticket_not_yet_valid"
+	// ReasonTicketExpired is used when the ticket has expired.
+	ReasonTicketExpired AuditReason = "ticket_expired"
+	// ReasonClockSkew is used when the client clock is too far out.
+	ReasonClockSkew AuditReason = "clock_skew"
+	// ReasonReplay is used when the authenticator has been seen before.
+	ReasonReplay AuditReason = "replay"
+	// ReasonInvalidPAC is used when the PAC signature couldn't be verified.
+	ReasonInvalidPAC AuditReason = "invalid_pac"
+	// ReasonBadMIC is used when the MIC couldn't be verified.
+	ReasonBadMIC AuditReason = "bad_mic"
+	// ReasonThrottled is used when the principal or remote address has
+	// failed too many times recently.
+	ReasonThrottled AuditReason = "throttled"
+	// ReasonDenied is used when the principal isn't allowed to log in as
+	// the SSH user.
+	ReasonDenied AuditReason = "denied"
+	// ReasonOther is used for any other failure.
+	ReasonOther AuditReason = "other"
+)
+
+// AuditEvent describes the outcome of a step of a GSSAPI authentication.
+// The SSH user is only known to the AllowLogin step, as is the remote
+// address unless the ServerContext was created with
+// NewContextWithRemoteAddr.
+type AuditEvent struct {
+	Stage   AuditStage
+	Backend string
+
+	Principal        string
+	ServicePrincipal string
+	User             string
+	RemoteAddr       net.Addr
+
+	Time     time.Time
+	Duration time.Duration
+
+	// Reason is ReasonNone and Err is nil if the step succeeded.
+	Reason AuditReason
+	Err    error
+}
+
+// WithAuditHook sets a function in the Server that is called with the
+// outcome of every AcceptSecContext, VerifyMIC and AllowLogin call. It is
+// called synchronously so it should not block.
+func WithAuditHook[T Server](hook func(AuditEvent)) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.auditHook = hook
+		}
+
+		return nil
+	}
+}
+
+// auditReason returns the reason for the error at the stage.
+func auditReason(stage AuditStage, err error) AuditReason {
+	switch {
+	case err == nil:
+		return ReasonNone
+	case errors.Is(err, ErrReplay):
+		return ReasonReplay
+	case errors.Is(err, ErrThrottled):
+		return ReasonThrottled
+	case stage == AuditAllowLogin:
+		return ReasonDenied
+	case stage == AuditVerifyMIC && !errors.Is(err, errNoContext):
+		return ReasonBadMIC
+	}
+
+	return backendAuditReason(err)
+}
+
+// audit logs the event, records it for throttling and passes it to any audit
+// hook.
+func (s *Server) audit(event AuditEvent) {
+	event.Backend = backend
+	event.Duration = time.Since(event.Time)
+	event.Reason = auditReason(event.Stage, event.Err)
+
+	keysAndValues := []any{
+		"stage", event.Stage,
+		"backend", event.Backend,
+		"principal", event.Principal,
+		"duration", event.Duration,
+	}
+
+	if event.User != "" {
+		keysAndValues = append(keysAndValues, "user", event.User)
+	}
+
+	if event.Err != nil {
+		s.logger.Info("authentication failed", append(keysAndValues, "reason", event.Reason, "error", event.Err.Error())...)
+	} else {
+		s.logger.V(1).Info("authentication succeeded", keysAndValues...)
+	}
+
+	if s.throttle.enabled() {
+		var err error
+
+		switch {
+		case event.Err != nil && event.Reason != ReasonThrottled:
+			err = s.throttle.fail(event.Principal, event.RemoteAddr, s.now())
+		case event.Err == nil && event.Stage == AuditAllowLogin:
+			err = s.throttle.reset(event.Principal, event.RemoteAddr)
+		}
+
+		if err != nil {
+			s.logger.Error(err, "unable to record authentication attempt")
+		}
+	}
+
+	if s.auditHook != nil {
+		s.auditHook(event)
+	}
+}
+
+// auditAllowLogin audits the outcome of AllowLogin.
+func (s *Server) auditAllowLogin(start time.Time, conn ssh.ConnMetadata, srcName string, err error) {
+	s.audit(AuditEvent{
+		Stage:      AuditAllowLogin,
+		Principal:  srcName,
+		User:       conn.User(),
+		RemoteAddr: conn.RemoteAddr(),
+		Time:       start,
+		Err:        err,
+	})
+}
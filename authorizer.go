@@ -0,0 +1,459 @@
+package sshkrb5
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	authToLocalDefault = "DEFAULT"
+	authToLocalRule    = "RULE:"
+)
+
+var (
+	errNotAuthorized   = errors.New("not authorized")
+	errNoLocalName     = errors.New("no local name")
+	errBadRule         = errors.New("invalid auth_to_local rule")
+	errBadSubstitution = errors.New("invalid substitution")
+)
+
+// WithAuthToLocal sets the auth_to_local rules in the Authorizer, in the same
+// format as krb5.conf. Each rule is either DEFAULT or
+// RULE:[n:string](regexp)s/pattern/replacement/g. It can be used more than
+// once.
+func WithAuthToLocal[T Authorizer](rules ...string) Option[T] {
+	return func(a *T) error {
+		parsed := make([]authToLocal, 0, len(rules))
+
+		for _, rule := range rules {
+			r, err := parseAuthToLocal(rule)
+			if err != nil {
+				return err
+			}
+
+			parsed = append(parsed, r)
+		}
+
+		if x, ok := any(a).(*Authorizer); ok {
+			x.rules = append(x.rules, parsed...)
+		}
+
+		return nil
+	}
+}
+
+// WithLocalRealm sets the realms considered local by the DEFAULT
+// auth_to_local rule in the Authorizer, which is the equivalent of the
+// default_realm and auth_to_local_realms settings. Without any local realms
+// the DEFAULT rule never matches. It can be used more than once.
+func WithLocalRealm[T Authorizer](realms ...string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Authorizer); ok {
+			x.realms = append(x.realms, realms...)
+		}
+
+		return nil
+	}
+}
+
+// WithK5Login enables or disables checking the .k5login file of the local
+// user in the Authorizer. It is enabled by default.
+func WithK5Login[T Authorizer](enabled bool) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Authorizer); ok {
+			x.k5login = enabled
+		}
+
+		return nil
+	}
+}
+
+// WithK5LoginDirectory sets the directory containing a .k5login file for
+// each user, named after the user, rather than using their home directory.
+// This is the equivalent of the k5login_directory setting.
+func WithK5LoginDirectory[T Authorizer](directory string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Authorizer); ok {
+			x.k5loginDirectory = directory
+		}
+
+		return nil
+	}
+}
+
+// Authorizer decides whether a Kerberos principal may log in as a local user
+// in the same way as krb5_kuserok, which is used by sshd.
+//
+// If the local user has a .k5login file then the principal must be listed in
+// it, otherwise the principal must map to the local user using the
+// auth_to_local rules.
+type Authorizer struct {
+	rules            []authToLocal
+	realms           []string
+	k5login          bool
+	k5loginDirectory string
+
+	logger logr.Logger
+}
+
+// NewAuthorizer returns a new Authorizer.
+func NewAuthorizer(options ...Option[Authorizer]) (*Authorizer, error) {
+	a := &Authorizer{
+		k5login: true,
+		logger:  logr.Discard(),
+	}
+
+	for _, option := range options {
+		if err := option(a); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// AllowLogin can be used as the AllowLogin function of
+// ssh.GSSAPIWithMICConfig.
+func (a *Authorizer) AllowLogin(conn ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+	if err := a.Authorize(srcName, conn.User()); err != nil {
+		a.logger.Info("login denied", "principal", srcName, "user", conn.User(), "reason", err.Error())
+
+		return nil, err
+	}
+
+	a.logger.Info("login allowed", "principal", srcName, "user", conn.User())
+
+	return &ssh.Permissions{}, nil
+}
+
+// Authorize returns nil if the principal may log in as the local user.
+func (a *Authorizer) Authorize(principal, username string) error {
+	if a.k5login {
+		allowed, found, err := a.checkK5Login(principal, username)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			if !allowed {
+				return fmt.Errorf("%w: %s is not listed in the .k5login file of %s", errNotAuthorized,
+					principal, username)
+			}
+
+			return nil
+		}
+	}
+
+	name, err := a.LocalName(principal)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNotAuthorized, err)
+	}
+
+	if name != username {
+		return fmt.Errorf("%w: %s maps to %s, not %s", errNotAuthorized, principal, name, username)
+	}
+
+	return nil
+}
+
+// LocalName maps the principal to a local username using the auth_to_local
+// rules, which is the equivalent of krb5_aname_to_localname. If there are no
+// rules then DEFAULT is used.
+func (a *Authorizer) LocalName(principal string) (string, error) {
+	components, realm := splitPrincipal(principal)
+
+	rules := a.rules
+	if len(rules) == 0 {
+		rules = []authToLocal{{isDefault: true}}
+	}
+
+	for _, rule := range rules {
+		if rule.isDefault {
+			if name, ok := a.defaultLocalName(components, realm); ok {
+				return name, nil
+			}
+
+			continue
+		}
+
+		if name, ok := rule.apply(components, realm); ok {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", errNoLocalName, principal)
+}
+
+func (a *Authorizer) defaultLocalName(components []string, realm string) (string, bool) {
+	if len(components) != 1 {
+		return "", false
+	}
+
+	for _, r := range a.realms {
+		if r == realm {
+			return components[0], true
+		}
+	}
+
+	return "", false
+}
+
+// checkK5Login returns whether the principal is listed in the .k5login
+// file of the user and whether the file was found.
+func (a *Authorizer) checkK5Login(principal, username string) (bool, bool, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return false, false, fmt.Errorf("%w: %w", errNotAuthorized, err)
+	}
+
+	path := filepath.Join(u.HomeDir, ".k5login")
+	if a.k5loginDirectory != "" {
+		path = filepath.Join(a.k5loginDirectory, username)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, false, nil
+		}
+
+		return false, true, fmt.Errorf("%w: %w", errNotAuthorized, err)
+	}
+
+	defer f.Close()
+
+	// Like krb5_kuserok, a file that could be written by someone else is
+	// treated as if it lists nobody
+	if err = checkK5LoginOwner(f, u); err != nil {
+		return false, true, fmt.Errorf("%w: %w", errNotAuthorized, err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == principal {
+			return true, true, nil
+		}
+	}
+
+	return false, true, scanner.Err()
+}
+
+// splitPrincipal splits a principal into its components and realm.
+func splitPrincipal(principal string) ([]string, string) {
+	name, realm := principal, ""
+	if i := strings.LastIndex(principal, "@"); i >= 0 {
+		name, realm = principal[:i], principal[i+1:]
+	}
+
+	return strings.Split(name, "/"), realm
+}
+
+type authToLocalSubstitution struct {
+	pattern     *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+// authToLocal is a single parsed auth_to_local rule.
+type authToLocal struct {
+	isDefault     bool
+	components    int
+	format        string
+	match         *regexp.Regexp
+	substitutions []authToLocalSubstitution
+}
+
+var authToLocalFormat = regexp.MustCompile(`\$(\d+)`) //nolint:gochecknoglobals
+
+// apply applies the rule to the principal, returning the local name and
+// whether the rule matched.
+func (r *authToLocal) apply(components []string, realm string) (string, bool) {
+	selection := strings.Join(components, "/") + "@" + realm
+
+	if r.format != "" {
+		if len(components) != r.components {
+			return "", false
+		}
+
+		ok := true
+
+		selection = authToLocalFormat.ReplaceAllStringFunc(r.format, func(s string) string {
+			n, _ := strconv.Atoi(s[1:])
+
+			switch {
+			case n == 0:
+				return realm
+			case n <= len(components):
+				return components[n-1]
+			default:
+				ok = false
+
+				return ""
+			}
+		})
+
+		if !ok {
+			return "", false
+		}
+	}
+
+	if r.match != nil && !r.match.MatchString(selection) {
+		return "", false
+	}
+
+	for _, s := range r.substitutions {
+		if s.global {
+			selection = s.pattern.ReplaceAllLiteralString(selection, s.replacement)
+
+			continue
+		}
+
+		if loc := s.pattern.FindStringIndex(selection); loc != nil {
+			selection = selection[:loc[0]] + s.replacement + selection[loc[1]:]
+		}
+	}
+
+	return selection, selection != ""
+}
+
+func parseAuthToLocal(rule string) (authToLocal, error) {
+	rule = strings.TrimSpace(rule)
+
+	if rule == authToLocalDefault {
+		return authToLocal{isDefault: true}, nil
+	}
+
+	s, ok := strings.CutPrefix(rule, authToLocalRule)
+	if !ok {
+		return authToLocal{}, fmt.Errorf("%w: %s", errBadRule, rule)
+	}
+
+	var (
+		r   authToLocal
+		err error
+	)
+
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return authToLocal{}, fmt.Errorf("%w: %s", errBadRule, rule)
+		}
+
+		n, format, ok := strings.Cut(s[1:end], ":")
+		if r.components, err = strconv.Atoi(n); !ok || err != nil || r.components < 1 {
+			return authToLocal{}, fmt.Errorf("%w: %s", errBadRule, rule)
+		}
+
+		r.format, s = format, s[end+1:]
+	}
+
+	if strings.HasPrefix(s, "(") {
+		end := matchingParen(s)
+		if end < 0 {
+			return authToLocal{}, fmt.Errorf("%w: %s", errBadRule, rule)
+		}
+
+		// The selection string must match the whole expression
+		if r.match, err = regexp.Compile("^(?:" + s[1:end] + ")$"); err != nil {
+			return authToLocal{}, fmt.Errorf("%w: %s: %w", errBadRule, rule, err)
+		}
+
+		s = s[end+1:]
+	}
+
+	for s != "" {
+		var substitution authToLocalSubstitution
+
+		if substitution, s, err = parseSubstitution(s); err != nil {
+			return authToLocal{}, fmt.Errorf("%w: %s: %w", errBadRule, rule, err)
+		}
+
+		r.substitutions = append(r.substitutions, substitution)
+	}
+
+	return r, nil
+}
+
+// matchingParen returns the index of the parenthesis that closes the one at
+// the start of s, or -1 if there isn't one.
+func matchingParen(s string) int {
+	depth := 0
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// parseSubstitution parses a single s/pattern/replacement/[g] substitution
+// from the start of s and returns the remainder.
+func parseSubstitution(s string) (authToLocalSubstitution, string, error) {
+	s, ok := strings.CutPrefix(strings.TrimSpace(s), "s/")
+	if !ok {
+		return authToLocalSubstitution{}, "", errBadSubstitution
+	}
+
+	fields := make([]string, 0, 2)
+
+	for len(fields) < 2 {
+		end := -1
+
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+
+				continue
+			}
+
+			if s[i] == '/' {
+				end = i
+
+				break
+			}
+		}
+
+		if end < 0 {
+			return authToLocalSubstitution{}, "", errBadSubstitution
+		}
+
+		fields, s = append(fields, s[:end]), s[end+1:]
+	}
+
+	pattern, err := regexp.Compile(fields[0])
+	if err != nil {
+		return authToLocalSubstitution{}, "", err
+	}
+
+	substitution := authToLocalSubstitution{
+		pattern:     pattern,
+		replacement: strings.ReplaceAll(fields[1], `\/`, "/"),
+	}
+
+	if strings.HasPrefix(s, "g") {
+		substitution.global, s = true, s[1:]
+	}
+
+	return substitution, s, nil
+}
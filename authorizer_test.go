@@ -0,0 +1,210 @@
+package sshkrb5_test
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/bodgit/sshkrb5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizerLocalName(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name      string
+		options   []sshkrb5.Option[sshkrb5.Authorizer]
+		principal string
+		localName string
+		err       bool
+	}{
+		{
+			"default",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithLocalRealm("EXAMPLE.COM"),
+			},
+			"alice@EXAMPLE.COM",
+			"alice",
+			false,
+		},
+		{
+			"default foreign realm",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithLocalRealm("EXAMPLE.COM"),
+			},
+			"alice@OTHER.COM",
+			"",
+			true,
+		},
+		{
+			"default instance",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithLocalRealm("EXAMPLE.COM"),
+			},
+			"alice/admin@EXAMPLE.COM",
+			"",
+			true,
+		},
+		{
+			"rule",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithAuthToLocal(`RULE:[1:$1@$0](.*@OTHER\.COM)s/@.*//`),
+			},
+			"alice@OTHER.COM",
+			"alice",
+			false,
+		},
+		{
+			"rule with instance",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithAuthToLocal(`RULE:[2:$1_$2@$0]((alice|bob)_admin@EXAMPLE\.COM)s/_admin@.*//`),
+			},
+			"bob/admin@EXAMPLE.COM",
+			"bob",
+			false,
+		},
+		{
+			"rule wrong number of components",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithAuthToLocal(`RULE:[2:$1@$0](.*@EXAMPLE\.COM)s/@.*//`),
+			},
+			"alice@EXAMPLE.COM",
+			"",
+			true,
+		},
+		{
+			"rule partial match",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithAuthToLocal(`RULE:[1:$1@$0](alice)s/@.*//`),
+			},
+			"alice@EXAMPLE.COM",
+			"",
+			true,
+		},
+		{
+			"rule global substitution",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithAuthToLocal(`RULE:[1:$1](.*)s/\./_/gs/^/x/`),
+			},
+			"first.last@EXAMPLE.COM",
+			"xfirst_last",
+			false,
+		},
+		{
+			"rule then default",
+			[]sshkrb5.Option[sshkrb5.Authorizer]{
+				sshkrb5.WithAuthToLocal(`RULE:[1:$1@$0](.*@OTHER\.COM)s/@.*//`, "DEFAULT"),
+				sshkrb5.WithLocalRealm("EXAMPLE.COM"),
+			},
+			"alice@EXAMPLE.COM",
+			"alice",
+			false,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			authorizer, err := sshkrb5.NewAuthorizer(table.options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			localName, err := authorizer.LocalName(table.principal)
+			if table.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, table.localName, localName)
+		})
+	}
+}
+
+func TestWithAuthToLocal(t *testing.T) {
+	t.Parallel()
+
+	for _, rule := range []string{
+		"NONE",
+		"RULE:[x:$1]",
+		"RULE:[1:$1](unbalanced",
+		"RULE:[1:$1](.*)s/unterminated",
+		"RULE:[1:$1](.*)x/a/b/",
+	} {
+		_, err := sshkrb5.NewAuthorizer(sshkrb5.WithAuthToLocal(rule))
+		assert.Error(t, err, rule)
+	}
+}
+
+func TestAuthorizerAuthorize(t *testing.T) {
+	t.Parallel()
+
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name      string
+		k5login   []byte
+		principal string
+		err       bool
+	}{
+		{
+			"auth_to_local",
+			nil,
+			current.Username + "@EXAMPLE.COM",
+			false,
+		},
+		{
+			"auth_to_local other user",
+			nil,
+			"nobody-else@EXAMPLE.COM",
+			true,
+		},
+		{
+			"k5login",
+			[]byte("# other principals\n  someone@OTHER.COM  \n"),
+			"someone@OTHER.COM",
+			false,
+		},
+		{
+			"k5login overrides auth_to_local",
+			[]byte("someone@OTHER.COM\n"),
+			current.Username + "@EXAMPLE.COM",
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+
+			if table.k5login != nil {
+				if err := os.WriteFile(filepath.Join(dir, current.Username), table.k5login, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			authorizer, err := sshkrb5.NewAuthorizer(sshkrb5.WithLocalRealm("EXAMPLE.COM"),
+				sshkrb5.WithK5LoginDirectory(dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = authorizer.Authorize(table.principal, current.Username)
+			if table.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
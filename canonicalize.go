@@ -0,0 +1,125 @@
+package sshkrb5
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// Resolver is the subset of *net.Resolver used to canonicalise the hostname
+// of the target.
+type Resolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// WithTrustDNS is the equivalent of GSSAPITrustDNS. The hostname of the
+// target is canonicalised through DNS, following any CNAME records, before
+// the service ticket is requested.
+func WithTrustDNS[T Client](trust bool) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.trustDNS = trust
+		}
+
+		return nil
+	}
+}
+
+// WithReverseDNS is the equivalent of the krb5.conf rdns setting. When the
+// hostname of the target is canonicalised the address it resolves to is
+// looked up in reverse DNS and the result used instead. It has no effect
+// unless WithTrustDNS is also used.
+func WithReverseDNS[T Client](rdns bool) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.rdns = rdns
+		}
+
+		return nil
+	}
+}
+
+// WithResolver sets the Resolver used to canonicalise the hostname of the
+// target. The default is net.DefaultResolver.
+func WithResolver[T Client](resolver Resolver) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.resolver = resolver
+		}
+
+		return nil
+	}
+}
+
+// canonicalizer rewrites the hostname in a service@hostname target.
+type canonicalizer struct {
+	trustDNS bool
+	rdns     bool
+	resolver Resolver
+}
+
+// canonicalTarget returns the target with the hostname canonicalised if
+// enabled. Any lookup that fails leaves the hostname as it was, which is how
+// the krb5 libraries behave.
+func (c *canonicalizer) canonicalTarget(ctx context.Context, target string, logger logr.Logger) string {
+	service, hostname, ok := strings.Cut(target, "@")
+	if !c.trustDNS || !ok || hostname == "" {
+		return target
+	}
+
+	resolver := c.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	canonical := hostname
+
+	if net.ParseIP(hostname) == nil {
+		cname, err := resolver.LookupCNAME(ctx, hostname)
+		if err != nil {
+			logger.Error(err, "unable to canonicalise hostname", "hostname", hostname)
+
+			return target
+		}
+
+		canonical = strings.TrimSuffix(cname, ".")
+	}
+
+	if c.rdns {
+		canonical = reverseHostname(ctx, resolver, canonical, logger)
+	}
+
+	canonical = strings.ToLower(canonical)
+
+	logger.V(1).Info("canonicalised hostname", "hostname", hostname, "canonical", canonical)
+
+	return service + "@" + canonical
+}
+
+// reverseHostname returns the name that the first address of hostname
+// resolves to in reverse DNS, or hostname if there isn't one.
+func reverseHostname(ctx context.Context, resolver Resolver, hostname string, logger logr.Logger) string {
+	addrs := []string{hostname}
+
+	if net.ParseIP(hostname) == nil {
+		var err error
+		if addrs, err = resolver.LookupHost(ctx, hostname); err != nil || len(addrs) == 0 {
+			logger.Error(err, "unable to resolve hostname", "hostname", hostname)
+
+			return hostname
+		}
+	}
+
+	names, err := resolver.LookupAddr(ctx, addrs[0])
+	if err != nil || len(names) == 0 {
+		logger.Error(err, "unable to look up address in reverse DNS", "address", addrs[0])
+
+		return hostname
+	}
+
+	return strings.TrimSuffix(names[0], ".")
+}
@@ -0,0 +1,67 @@
+package sshkrb5
+
+import (
+	"os"
+
+	"github.com/go-logr/logr"
+	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/crypto/ssh"
+)
+
+// CCacheFile is a private file credentials cache, typically holding
+// credentials delegated by a client. It should be destroyed when the session
+// that uses it ends, which is the equivalent of GSSAPICleanupCredentials.
+type CCacheFile struct {
+	path string
+
+	logger logr.Logger
+}
+
+// Path returns the path of the credentials cache file.
+func (f *CCacheFile) Path() string {
+	return f.path
+}
+
+// Name returns the credentials cache name suitable for KRB5CCNAME.
+func (f *CCacheFile) Name() string {
+	return "FILE:" + f.path
+}
+
+// Environ returns the KRB5CCNAME environment variable, in the form expected
+// by ssh.Session.Setenv or exec.Cmd.Env.
+func (f *CCacheFile) Environ() string {
+	return "KRB5CCNAME=" + f.Name()
+}
+
+// Destroy overwrites the credentials cache with zeroes and then removes it.
+// It is safe to call more than once.
+func (f *CCacheFile) Destroy() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(make([]byte, fi.Size()))
+
+	return multierror.Append(err, file.Close(), os.Remove(f.path)).ErrorOrNil()
+}
+
+// DestroyOnClose destroys the credentials cache once conn is closed.
+func (f *CCacheFile) DestroyOnClose(conn ssh.Conn) {
+	go func() {
+		_ = conn.Wait()
+
+		if err := f.Destroy(); err != nil {
+			f.logger.Error(err, "unable to destroy credentials cache", "path", f.path)
+		}
+	}()
+}
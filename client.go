@@ -0,0 +1,20 @@
+package sshkrb5
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthMethod returns an ssh.AuthMethod that authenticates to target using a
+// new ClientContext, so the same Client can be used by many concurrent calls
+// to ssh.Dial.
+func (c *Client) AuthMethod(target string) ssh.AuthMethod {
+	return ssh.GSSAPIWithMICAuthMethod(c.NewContext(), target)
+}
+
+// AuthMethodContext is like AuthMethod except the handshake gives up waiting
+// for the KDC once ctx is done.
+func (c *Client) AuthMethodContext(ctx context.Context, target string) ssh.AuthMethod {
+	return ssh.GSSAPIWithMICAuthMethod(c.NewContextWithContext(ctx), target)
+}
@@ -0,0 +1,66 @@
+package sshkrb5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errAbandoned = errors.New("abandoned waiting for the KDC")
+
+// NewClient returns a new Client using the current user.
+func NewClient(options ...Option[Client]) (*Client, error) {
+	return NewClientContext(context.Background(), options...)
+}
+
+// NewContextWithContext returns a new ClientContext that shares the
+// credentials of the Client but has its own security context. The handshake
+// gives up waiting for the KDC once ctx is done, as ssh.GSSAPIClient has no
+// way to pass a context.
+func (c *Client) NewContextWithContext(ctx context.Context) *ClientContext {
+	cc := c.NewContext()
+	cc.handshakeCtx = ctx
+
+	return cc
+}
+
+// withContext calls f and returns its result, unless ctx is done first in
+// which case an error wrapping ctx.Err() is returned. Calls to the KDC can't
+// be interrupted so f carries on in the background, tracked by wg, and if it
+// then succeeds abandon is called with the result so it can be cleaned up.
+func withContext[T any](ctx context.Context, wg *sync.WaitGroup, f func() (T, error), abandon func(T)) (T, error) {
+	var zero T
+
+	if err := ctx.Err(); err != nil {
+		return zero, fmt.Errorf("%w: %w", errAbandoned, err)
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+
+	ch, abandoned := make(chan result), make(chan struct{})
+
+	wg.Go(func() {
+		v, err := f()
+
+		select {
+		case ch <- result{v, err}:
+		case <-abandoned:
+			if err == nil && abandon != nil {
+				abandon(v)
+			}
+		}
+	})
+
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-ctx.Done():
+		close(abandoned)
+
+		return zero, fmt.Errorf("%w: %w", errAbandoned, ctx.Err())
+	}
+}
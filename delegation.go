@@ -0,0 +1,47 @@
+package sshkrb5
+
+// DelegationPolicy controls when a Client delegates its credentials to the
+// server.
+type DelegationPolicy int
+
+const (
+	// DelegateRequested delegates credentials only when InitSecContext is
+	// asked to, which is the default.
+	DelegateRequested DelegationPolicy = iota
+	// DelegateNever never delegates credentials, even when InitSecContext
+	// is asked to.
+	DelegateNever
+	// DelegateAlways always delegates credentials, which is the equivalent
+	// of GSSAPIDelegateCredentials.
+	DelegateAlways
+	// DelegateOKAsDelegate delegates credentials only when the KDC has set
+	// the ok-as-delegate flag on the service ticket, which is the
+	// equivalent of the krb5.conf enforce_ok_as_delegate setting.
+	DelegateOKAsDelegate
+)
+
+// WithDelegationPolicy sets when the Client delegates its credentials.
+// Credentials are only delegated if the TGT is forwardable.
+func WithDelegationPolicy[T Client](policy DelegationPolicy) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.delegation = policy
+		}
+
+		return nil
+	}
+}
+
+// delegate returns whether credentials should be delegated, subject to the
+// ok-as-delegate flag if that is the policy.
+func (p DelegationPolicy) delegate(requested bool) bool {
+	switch p {
+	case DelegateNever:
+		return false
+	case DelegateAlways, DelegateOKAsDelegate:
+		return true
+	case DelegateRequested:
+	}
+
+	return requested
+}
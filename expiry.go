@@ -0,0 +1,73 @@
+package sshkrb5
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Expiry returns when the ticket used to establish the default security
+// context expires.
+func (s *Server) Expiry() (time.Time, error) {
+	return s.defaultContext.Expiry()
+}
+
+// AfterExpiry calls f once the ticket used to establish the default security
+// context expires, unless conn is closed first.
+func (s *Server) AfterExpiry(conn ssh.Conn, f func()) error {
+	return s.defaultContext.AfterExpiry(conn, f)
+}
+
+// CloseOnExpiry closes conn once the ticket used to establish the default
+// security context expires.
+func (s *Server) CloseOnExpiry(conn ssh.Conn) error {
+	return s.defaultContext.CloseOnExpiry(conn)
+}
+
+// Expiry returns when the ticket used to establish the security context
+// expires.
+func (c *ServerContext) Expiry() (time.Time, error) {
+	info, err := c.PeerInfo()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if info.EndTime.IsZero() {
+		return time.Time{}, errNotSupported
+	}
+
+	return info.EndTime, nil
+}
+
+// AfterExpiry calls f once the ticket used to establish the security context
+// expires, unless conn is closed first. This can be used to warn the user or
+// flag the connection rather than closing it.
+func (c *ServerContext) AfterExpiry(conn ssh.Conn, f func()) error {
+	expiry, err := c.Expiry()
+	if err != nil {
+		return err
+	}
+
+	timer := time.AfterFunc(expiry.Sub(c.server.now()), f)
+
+	go func() {
+		_ = conn.Wait()
+
+		timer.Stop()
+	}()
+
+	return nil
+}
+
+// CloseOnExpiry closes conn once the ticket used to establish the security
+// context expires so the connection can't outlive the ticket.
+func (c *ServerContext) CloseOnExpiry(conn ssh.Conn) error {
+	return c.AfterExpiry(conn, func() {
+		c.server.logger.Info("ticket expired, closing connection", "user", conn.User(),
+			"remote", conn.RemoteAddr().String())
+
+		if err := conn.Close(); err != nil {
+			c.server.logger.Error(err, "unable to close connection", "user", conn.User())
+		}
+	})
+}
@@ -4,3 +4,19 @@ var (
 	ErrNotSupported = errNotSupported
 	OSHostname      = &osHostname //nolint:gochecknoglobals
 )
+
+// Len returns the number of entries in the cache.
+func (c *MemoryReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// Keys returns the number of keys with failed attempts in the store.
+func (s *MemoryThrottleStore) Keys() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.entries)
+}
@@ -4,14 +4,25 @@
 package sshkrb5
 
 import (
-	wrapper "github.com/bodgit/gssapi"
+	"context"
+	"net"
+	"sync"
+	"time"
+
 	"github.com/go-logr/logr"
-	multierror "github.com/hashicorp/go-multierror"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
 	"github.com/jcmturner/gokrb5/v8/gssapi"
 	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
 	"github.com/jcmturner/gokrb5/v8/types"
 )
 
+const backend = "gokrb5"
+
 // WithConfig sets the configuration in the Client.
 func WithConfig[T Client](config string) Option[T] {
 	return func(a *T) error {
@@ -63,9 +74,182 @@ func WithKeytab[T Client | Server](keytab string) Option[T] {
 		switch x := any(a).(type) {
 		case *Client:
 			x.keytab = &keytab
+			x.keytabData = nil
 			x.password = ""
+			x.ccache = ""
+			x.ccacheData = nil
 		case *Server:
 			x.keytab = keytab
+			x.keytabData = nil
+		}
+
+		return nil
+	}
+}
+
+// WithKeytabBytes sets the keytab contents in either a Client or Server so
+// that it doesn't need to be read from disk.
+func WithKeytabBytes[T Client | Server](b []byte) Option[T] {
+	return func(a *T) error {
+		kt := keytab.New()
+		if err := kt.Unmarshal(b); err != nil {
+			return err
+		}
+
+		return WithParsedKeytab[T](kt)(a)
+	}
+}
+
+// WithParsedKeytab sets the keytab in either a Client or Server so that it
+// doesn't need to be read from disk.
+func WithParsedKeytab[T Client | Server](kt *keytab.Keytab) Option[T] {
+	return func(a *T) error {
+		switch x := any(a).(type) {
+		case *Client:
+			x.keytab = nil
+			x.keytabData = kt
+			x.password = ""
+			x.ccache = ""
+			x.ccacheData = nil
+		case *Server:
+			x.keytab = ""
+			x.keytabData = kt
+		}
+
+		return nil
+	}
+}
+
+// WithClockSkew sets the maximum permitted clock skew in either a Client or
+// Server. For a Client this overrides the clockskew setting in the
+// configuration.
+func WithClockSkew[T Client | Server](skew time.Duration) Option[T] {
+	return func(a *T) error {
+		switch x := any(a).(type) {
+		case *Client:
+			x.clockSkew = skew
+		case *Server:
+			x.clockSkew = skew
+		}
+
+		return nil
+	}
+}
+
+// WithClock sets the source of the current time in either a Client or
+// Server, which is used for creating authenticators and checking their
+// validity, along with that of tickets.
+func WithClock[T Client | Server](now func() time.Time) Option[T] {
+	return func(a *T) error {
+		switch x := any(a).(type) {
+		case *Client:
+			x.now = now
+		case *Server:
+			x.now = now
+		}
+
+		return nil
+	}
+}
+
+// WithReplayCache sets the ReplayCache in the Server. By default a
+// MemoryReplayCache is used, nil disables replay detection.
+func WithReplayCache[T Server](cache ReplayCache) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.replayCache = cache
+		}
+
+		return nil
+	}
+}
+
+// WithKeytabValidation sets whether NewServer checks that the keytab has
+// usable keys for the service principals, which is the default. Disabling it
+// allows the keytab to be provisioned after the Server is created.
+func WithKeytabValidation[T Server](validate bool) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.validate = validate
+		}
+
+		return nil
+	}
+}
+
+// WithWeakKeys sets whether NewServer accepts a keytab that only has weak
+// keys for a service principal, such as RC4 or triple DES, when validating
+// the keytab. The default is to reject it with ErrWeakKey, if accepted a
+// warning is logged instead.
+func WithWeakKeys[T Server](allow bool) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.weakKeys = allow
+		}
+
+		return nil
+	}
+}
+
+// WithCCache sets the credentials cache in the Client rather than using the
+// default from KRB5CCNAME. It can be a FILE: or plain path, a DIR: collection
+// of credentials caches, or DIR::path for a single cache in a collection.
+func WithCCache[T Client](name string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.ccache = name
+			x.ccacheData = nil
+			x.password = ""
+			x.keytab = nil
+			x.keytabData = nil
+		}
+
+		return nil
+	}
+}
+
+// WithCCacheBytes sets the credentials cache contents in the Client so that
+// it doesn't need to be read from disk.
+func WithCCacheBytes[T Client](b []byte) Option[T] {
+	return func(a *T) error {
+		cache := new(credentials.CCache)
+		if err := cache.Unmarshal(b); err != nil {
+			return err
+		}
+
+		if x, ok := any(a).(*Client); ok {
+			x.ccache = ""
+			x.ccacheData = cache
+			x.password = ""
+			x.keytab = nil
+			x.keytabData = nil
+		}
+
+		return nil
+	}
+}
+
+// WithCCachePrincipal sets the principal in the Client, in the form
+// user@REALM or just user for any realm, whose credentials cache is used
+// from a collection. Any other credentials cache must be for the principal.
+func WithCCachePrincipal[T Client](principal string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.ccachePrincipal = principal
+		}
+
+		return nil
+	}
+}
+
+// WithStoreCCache sets a credentials cache file in the Client that the TGT
+// obtained by logging in with a password or keytab is stored in, along with
+// any service tickets, like kinit. While the stored TGT is valid it is used
+// instead of logging in again, and other Clients can use it with WithCCache.
+func WithStoreCCache[T Client](name string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Client); ok {
+			x.storeCCache = name
 		}
 
 		return nil
@@ -73,21 +257,57 @@ func WithKeytab[T Client | Server](keytab string) Option[T] {
 }
 
 // Client implements the ssh.GSSAPIClient interface.
+//
+// The ssh.GSSAPIClient methods on Client share a single security context so
+// a Client used directly can only safely make one connection at a time. Use
+// NewContext to create an isolated ClientContext for each connection, which
+// all share the credentials of the Client.
 type Client struct {
-	config   string
-	domain   string
-	username string
-	password string
-	keytab   *string
-
-	initiator *wrapper.Initiator
+	config     string
+	domain     string
+	username   string
+	password   string
+	keytab     *string
+	keytabData *keytab.Keytab
+	clockSkew  time.Duration
+	now        func() time.Time
+
+	ccache          string
+	ccacheData      *credentials.CCache
+	ccachePrincipal string
+	storeCCache     string
+
+	// mu protects stored, which holds the TGT and service tickets
+	mu     sync.Mutex
+	stored *credentials.CCache
+	// loginMu collapses concurrent logins into one
+	loginMu sync.Mutex
+
+	// stop and done control the background renewal of the TGT
+	stop chan struct{}
+	done chan struct{}
+
+	client *client.Client
+
+	canonicalizer
+
+	// exchanges tracks calls that may still be waiting for the KDC after
+	// being abandoned
+	exchanges sync.WaitGroup
+	// serverIdentity overrides the target if set
+	serverIdentity string
+	delegation     DelegationPolicy
+
+	defaultContext *ClientContext
 
 	logger logr.Logger
 }
 
-// NewClient returns a new Client using the current user.
-func NewClient(options ...Option[Client]) (*Client, error) {
+// NewClientContext returns a new Client using the current user. It gives up
+// waiting for the KDC once ctx is done.
+func NewClientContext(ctx context.Context, options ...Option[Client]) (*Client, error) {
 	c := &Client{
+		now:    time.Now,
 		logger: logr.Discard(),
 	}
 
@@ -99,60 +319,137 @@ func NewClient(options ...Option[Client]) (*Client, error) {
 		}
 	}
 
-	initiatorOptions := []wrapper.Option[wrapper.Initiator]{
-		wrapper.WithConfig(c.config),
-		wrapper.WithLogger[wrapper.Initiator](c.logger),
+	if c.client, err = c.newClient(); err != nil {
+		return nil, err
+	}
+
+	// The client is destroyed if the login fails, or if it succeeds after
+	// being abandoned
+	if _, err = withContext(ctx, &c.exchanges, func() (struct{}, error) {
+		login := c.client.AffirmLogin
+		if c.canLogin() {
+			login = c.loadStoredCCache
+		}
+
+		if err := login(); err != nil {
+			c.client.Destroy()
+
+			return struct{}{}, err
+		}
+
+		return struct{}{}, nil
+	}, func(struct{}) {
+		c.client.Destroy()
+	}); err != nil {
+		return nil, err
+	}
+
+	c.stop, c.done = make(chan struct{}), make(chan struct{})
+
+	go c.renew()
+
+	c.defaultContext = c.NewContext()
+
+	return c, nil
+}
+
+// NewContext returns a new ClientContext that shares the credentials of the
+// Client but has its own security context.
+func (c *Client) NewContext() *ClientContext {
+	return &ClientContext{
+		client:       c,
+		handshakeCtx: context.Background(),
+	}
+}
+
+func (c *Client) newClient() (*client.Client, error) {
+	cfg, err := c.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.clockSkew > 0 {
+		cfg.LibDefaults.Clockskew = c.clockSkew
+	}
+
+	settings := []func(*client.Settings){
+		client.DisablePAFXFAST(true),
 	}
 
 	switch {
 	case c.usePassword():
-		initiatorOptions = append(initiatorOptions,
-			wrapper.WithDomain(c.domain),
-			wrapper.WithUsername(c.username),
-			wrapper.WithPassword(c.password))
+		return client.NewWithPassword(c.username, c.domain, c.password, cfg, settings...), nil
 	case c.useKeytab():
-		initiatorOptions = append(initiatorOptions,
-			wrapper.WithDomain(c.domain),
-			wrapper.WithUsername(c.username),
-			wrapper.WithKeytab[wrapper.Initiator](*c.keytab))
-	default:
-		c.logger.Info("using default session")
+		kt := c.keytabData
+		if kt == nil {
+			if kt, err = loadClientKeytab(c.logger, *c.keytab); err != nil {
+				return nil, err
+			}
+		}
+
+		return client.NewWithKeytab(c.username, c.domain, kt, cfg, settings...), nil
 	}
 
-	if c.initiator, err = wrapper.NewInitiator(initiatorOptions...); err != nil {
+	cache := c.ccacheData
+	if cache == nil {
+		if c.ccache == "" {
+			c.logger.Info("using default session")
+		}
+
+		if cache, err = loadCCache(c.logger, c.ccache, c.ccachePrincipal); err != nil {
+			return nil, err
+		}
+	} else if err = checkCCachePrincipal(cache, c.ccachePrincipal); err != nil {
 		return nil, err
 	}
 
-	return c, nil
+	c.stored = cache
+
+	return client.NewFromCCache(cache, cfg, settings...)
+}
+
+func (c *Client) loadConfig() (*config.Config, error) {
+	if c.config != "" {
+		return config.NewFromString(c.config)
+	}
+
+	return loadConfig(c.logger)
 }
 
 // Close deletes any active security context and unloads any underlying
 // libraries as necessary.
 func (c *Client) Close() error {
-	return multierror.Append(c.DeleteSecContext(), c.initiator.Close()).ErrorOrNil()
+	err := c.DeleteSecContext()
+
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+
+		c.stop = nil
+	}
+
+	c.exchanges.Wait()
+	c.client.Destroy()
+
+	return err
 }
 
 // InitSecContext is called by the ssh.Client to initialise or advance the
 // security context.
 func (c *Client) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
-	flags := gssapi.ContextFlagMutual | gssapi.ContextFlagInteg
-	if isGSSDelegCreds {
-		flags |= gssapi.ContextFlagDeleg
-	}
-
-	return c.initiator.Initiate(target, flags, token)
+	return c.defaultContext.InitSecContext(target, token, isGSSDelegCreds)
 }
 
 // GetMIC is called by the ssh.Client to authenticate the user using the
 // negotiated security context.
 func (c *Client) GetMIC(micField []byte) ([]byte, error) {
-	return c.initiator.MakeSignature(micField)
+	return c.defaultContext.GetMIC(micField)
 }
 
 // DeleteSecContext is called by the ssh.Client to tear down any active
 // security context.
 func (c *Client) DeleteSecContext() error {
-	return nil
+	return c.defaultContext.DeleteSecContext()
 }
 
 func (c *Client) usePassword() bool {
@@ -160,15 +457,119 @@ func (c *Client) usePassword() bool {
 }
 
 func (c *Client) useKeytab() bool {
-	return c.domain != "" && c.username != "" && c.keytab != nil
+	return c.domain != "" && c.username != "" && (c.keytab != nil || c.keytabData != nil)
+}
+
+func (c *Client) canLogin() bool {
+	return c.usePassword() || c.useKeytab()
+}
+
+// ClientContext implements the ssh.GSSAPIClient interface for a single
+// connection.
+type ClientContext struct {
+	client       *Client
+	handshakeCtx context.Context //nolint:containedctx
+	// target is the canonicalised target
+	target string
+
+	initiator *initiator
+}
+
+// InitSecContext is called by the ssh.Client to initialise or advance the
+// security context.
+func (c *ClientContext) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	if len(token) == 0 || c.target == "" {
+		if c.client.serverIdentity != "" {
+			c.target = c.client.serverIdentity
+		} else {
+			c.target = c.client.canonicalTarget(c.handshakeCtx, target, c.client.logger)
+		}
+	}
+
+	target = c.target
+
+	flags := gssapi.ContextFlagMutual | gssapi.ContextFlagInteg
+	if c.client.delegation.delegate(isGSSDelegCreds) {
+		flags |= gssapi.ContextFlagDeleg
+	}
+
+	if c.initiator == nil {
+		c.initiator = newInitiator(c.client.client, c.client.now)
+		c.initiator.getServiceTicket = c.serviceTicket
+		c.initiator.forwardCredentials = c.forwardCredentials
+	}
+
+	return c.initiator.initiate(target, flags, token)
+}
+
+// serviceTicket returns a service ticket from the Client, giving up if the
+// handshake context is done first.
+func (c *ClientContext) serviceTicket(spn string) (messages.Ticket, types.EncryptionKey, asn1.BitString, error) {
+	type result struct {
+		ticket      messages.Ticket
+		key         types.EncryptionKey
+		ticketFlags asn1.BitString
+	}
+
+	r, err := withContext(c.handshakeCtx, &c.client.exchanges, func() (result, error) {
+		ticket, key, ticketFlags, err := c.client.serviceTicket(spn)
+
+		return result{ticket, key, ticketFlags}, err
+	}, nil)
+
+	return r.ticket, r.key, r.ticketFlags, err
+}
+
+// forwardCredentials returns any credentials to delegate from the Client,
+// giving up if the handshake context is done first.
+func (c *ClientContext) forwardCredentials(spn string, key types.EncryptionKey,
+	ticketFlags asn1.BitString) ([]byte, error) {
+	return withContext(c.handshakeCtx, &c.client.exchanges, func() ([]byte, error) {
+		return c.client.forwardCredentials(spn, key, ticketFlags)
+	}, nil)
+}
+
+// GetMIC is called by the ssh.Client to authenticate the user using the
+// negotiated security context.
+func (c *ClientContext) GetMIC(micField []byte) ([]byte, error) {
+	if c.initiator == nil {
+		return nil, errNoContext
+	}
+
+	return c.initiator.makeSignature(micField)
+}
+
+// DeleteSecContext is called by the ssh.Client to tear down any active
+// security context.
+func (c *ClientContext) DeleteSecContext() error {
+	c.initiator = nil
+
+	return nil
 }
 
 // Server implements the ssh.GSSAPIServer interface.
+//
+// The ssh.GSSAPIServer methods on Server share a single security context so
+// a Server used directly can only safely handle one connection at a time.
+// Use NewContext to create an isolated ServerContext for each connection.
 type Server struct {
-	strict bool
-	keytab string
+	strict     bool
+	keytab     string
+	keytabData *keytab.Keytab
+	principals []string
+	validate   bool
+	weakKeys   bool
+
+	keytabs     *keytabCache
+	replayCache ReplayCache
+	clockSkew   time.Duration
+	now         func() time.Time
+
+	policy    policy
+	auditHook func(AuditEvent)
+	throttle  throttle
 
-	acceptor *wrapper.Acceptor
+	defaultContext *ServerContext
 
 	logger logr.Logger
 }
@@ -176,8 +577,12 @@ type Server struct {
 // NewServer returns a new Server.
 func NewServer(options ...Option[Server]) (*Server, error) {
 	s := &Server{
-		strict: true,
-		logger: logr.Discard(),
+		strict:      true,
+		validate:    true,
+		replayCache: NewMemoryReplayCache(),
+		clockSkew:   defaultClockSkew,
+		now:         time.Now,
+		logger:      logr.Discard(),
 	}
 
 	for _, option := range options {
@@ -186,31 +591,38 @@ func NewServer(options ...Option[Server]) (*Server, error) {
 		}
 	}
 
-	acceptorOptions := []wrapper.Option[wrapper.Acceptor]{
-		wrapper.WithLogger[wrapper.Acceptor](s.logger),
-		wrapper.WithKeytab[wrapper.Acceptor](s.keytab),
-	}
-
-	if s.strict {
+	if s.strict && len(s.principals) == 0 {
 		hostname, err := osHostname()
 		if err != nil {
 			return nil, err
 		}
 
-		principal := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, "host/"+hostname)
-
-		acceptorOptions = append(acceptorOptions, wrapper.WithServicePrincipal(&principal))
+		s.principals = []string{"host/" + hostname}
 	}
 
-	var err error
+	if s.keytabData == nil {
+		s.keytabs = newKeytabCache(s.keytab, s.logger.WithName("keytab"))
+	}
 
-	if s.acceptor, err = wrapper.NewAcceptor(acceptorOptions...); err != nil {
-		return nil, err
+	if s.validate {
+		if err := s.validateKeytab(); err != nil {
+			return nil, err
+		}
 	}
 
+	s.defaultContext = s.NewContext()
+
 	return s, nil
 }
 
+// NewContext returns a new ServerContext that shares the configuration of
+// the Server but has its own security context.
+func (s *Server) NewContext() *ServerContext {
+	return &ServerContext{
+		server: s,
+	}
+}
+
 // Close deletes any active security context and unloads any underlying
 // libraries as necessary.
 func (s *Server) Close() error {
@@ -220,19 +632,205 @@ func (s *Server) Close() error {
 // AcceptSecContext is called by the ssh.ServerConn to accept and advance the
 // security context.
 func (s *Server) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
-	output, cont, err := s.acceptor.Accept(token)
-
-	return output, s.acceptor.PeerName(), cont, err
+	return s.defaultContext.AcceptSecContext(token)
 }
 
 // VerifyMIC is called by the ssh.ServerConn to authenticate the user using
 // the negotiated security context.
 func (s *Server) VerifyMIC(micField, micToken []byte) error {
-	return s.acceptor.VerifySignature(micField, micToken)
+	return s.defaultContext.VerifyMIC(micField, micToken)
 }
 
 // DeleteSecContext is called by the ssh.ServerConn to tear down any active
 // security context.
 func (s *Server) DeleteSecContext() error {
+	return s.defaultContext.DeleteSecContext()
+}
+
+func (s *Server) newAcceptor() (*acceptor, error) {
+	var (
+		kt     = s.keytabData
+		reload func() (*keytab.Keytab, error)
+	)
+
+	if s.keytabs != nil {
+		var err error
+
+		if kt, err = s.keytabs.get(); err != nil {
+			return nil, err
+		}
+
+		reload = s.keytabs.reload
+	}
+
+	principals := make([]types.PrincipalName, 0, len(s.principals))
+	for _, principal := range s.principals {
+		principals = append(principals, types.NewPrincipalName(nametype.KRB_NT_SRV_HST, principal))
+	}
+
+	acceptor := newAcceptor(kt, principals, s.logger.WithName("acceptor"))
+	acceptor.reload = reload
+	acceptor.replayCache = s.replayCache
+	acceptor.clockSkew = s.clockSkew
+	acceptor.now = s.now
+	acceptor.requirePAC = len(s.policy.groups) > 0
+	acceptor.throttle = &s.throttle
+
+	return acceptor, nil
+}
+
+// ServerContext implements the ssh.GSSAPIServer interface for a single
+// connection.
+type ServerContext struct {
+	server *Server
+
+	acceptor         *acceptor
+	delegated        *credentials.CCache
+	servicePrincipal string
+	peerInfo         *PeerInfo
+
+	remoteAddr net.Addr
+}
+
+// AcceptSecContext is called by the ssh.ServerConn to accept and advance the
+// security context.
+func (c *ServerContext) AcceptSecContext(token []byte) (_ []byte, _ string, _ bool, err error) {
+	defer func(start time.Time) {
+		c.auditAcceptSecContext(start, err)
+	}(time.Now())
+
+	if err = c.server.throttle.check("", c.remoteAddr, c.server.now()); err != nil {
+		return nil, "", false, err
+	}
+
+	if c.acceptor == nil {
+		acceptor, err := c.server.newAcceptor()
+		if err != nil {
+			return nil, "", false, err
+		}
+
+		c.acceptor = acceptor
+		c.delegated = nil
+		c.servicePrincipal = ""
+		c.peerInfo = nil
+	}
+
+	output, cont, err := c.acceptor.accept(token)
+	if err == nil && c.acceptor.established {
+		c.servicePrincipal = c.acceptor.servicePrincipal
+	}
+
+	return output, c.acceptor.peerName, cont, err
+}
+
+// auditAcceptSecContext audits the outcome of AcceptSecContext once the
+// security context is established or has failed, including any error that
+// was only sent to the initiator.
+func (c *ServerContext) auditAcceptSecContext(start time.Time, err error) {
+	event := AuditEvent{
+		Stage:      AuditAcceptSecContext,
+		RemoteAddr: c.remoteAddr,
+		Time:       start,
+		Err:        err,
+	}
+
+	if c.acceptor != nil {
+		if event.Err == nil && c.acceptor.krbError != nil {
+			event.Err = c.acceptor.krbError
+		}
+
+		if event.Err == nil && !c.acceptor.established {
+			return
+		}
+
+		event.Principal = c.acceptor.peerName
+		event.ServicePrincipal = c.acceptor.servicePrincipal
+	}
+
+	c.server.audit(event)
+}
+
+// VerifyMIC is called by the ssh.ServerConn to authenticate the user using
+// the negotiated security context.
+func (c *ServerContext) VerifyMIC(micField, micToken []byte) (err error) {
+	defer func(start time.Time) {
+		var principal string
+		if c.acceptor != nil {
+			principal = c.acceptor.peerName
+		}
+
+		c.server.audit(AuditEvent{
+			Stage:            AuditVerifyMIC,
+			Principal:        principal,
+			RemoteAddr:       c.remoteAddr,
+			ServicePrincipal: c.servicePrincipal,
+			Time:             start,
+			Err:              err,
+		})
+	}(time.Now())
+
+	if c.acceptor == nil {
+		return errNoContext
+	}
+
+	if err = c.acceptor.verifySignature(micField, micToken); err != nil {
+		return err
+	}
+
+	c.delegated = c.acceptor.delegated
+	c.peerInfo = c.acceptor.peerInfo
+
+	return nil
+}
+
+// DeleteSecContext is called by the ssh.ServerConn to tear down any active
+// security context.
+func (c *ServerContext) DeleteSecContext() error {
+	c.acceptor = nil
+
 	return nil
 }
+
+// DelegatedCredentials returns any credentials delegated by the client once
+// the security context has been established and the MIC verified. It
+// returns nil if the client did not delegate any credentials. The
+// credentials remain available after the security context is deleted.
+func (c *ServerContext) DelegatedCredentials() (*credentials.CCache, error) {
+	return c.delegated, nil
+}
+
+// PeerInfo returns details of the principal authenticated by the security
+// context once it has been established and the MIC verified. They remain
+// available after the security context is deleted.
+func (c *ServerContext) PeerInfo() (*PeerInfo, error) {
+	if c.peerInfo == nil {
+		return nil, errNoContext
+	}
+
+	return c.peerInfo, nil
+}
+
+// ServicePrincipal returns the service principal the client authenticated
+// against once the security context has been established. In strict mode
+// this is one of the configured principals, otherwise it can be any host-based
+// service principal in the keytab.
+func (c *ServerContext) ServicePrincipal() (string, error) {
+	if c.servicePrincipal == "" {
+		return "", errNoContext
+	}
+
+	return c.servicePrincipal, nil
+}
+
+// WriteDelegatedCredentials writes any credentials delegated by the client to
+// a new private file credentials cache in dir, or the default directory for
+// temporary files if dir is empty. It returns nil if the client did not
+// delegate any credentials. The caller is responsible for destroying the
+// credentials cache when the session ends.
+func (c *ServerContext) WriteDelegatedCredentials(dir string) (*CCacheFile, error) {
+	if c.delegated == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	return writeCCacheFile(c.delegated, dir, c.server.logger)
+}
@@ -0,0 +1,530 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/pac"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	defaultClockSkew = 10 * time.Second
+
+	// RFC 4121 section 4.1.1 authenticator checksum layout
+	checksumLength    = 24
+	checksumDelegOpt  = 1
+	checksumDelegPart = 28
+
+	// MS-PAC section 2.4 buffer type of the KERB_VALIDATION_INFO
+	pacLogonInfo = 1
+)
+
+var (
+	errKRBError        = errors.New("received kerberos error")
+	errNotAPReq        = errors.New("didn't receive an AP-REQ")
+	errInvalidChecksum = errors.New("invalid authenticator checksum")
+)
+
+// acceptor represents the server side of a single GSSAPI exchange.
+type acceptor struct {
+	secContext
+
+	keytab     *keytab.Keytab
+	reload     func() (*keytab.Keytab, error)
+	principals []types.PrincipalName
+	clockSkew  time.Duration
+	now        func() time.Time
+
+	replayCache ReplayCache
+	requirePAC  bool
+	throttle    *throttle
+
+	delegated        *credentials.CCache
+	servicePrincipal string
+	logonInfo        *LogonInfo
+	krbError         error
+	peerInfo         *PeerInfo
+
+	logger logr.Logger
+}
+
+func newAcceptor(kt *keytab.Keytab, principals []types.PrincipalName, logger logr.Logger) *acceptor {
+	return &acceptor{
+		secContext: secContext{
+			acceptor:     true,
+			sequenceMask: math.MaxUint32,
+		},
+		keytab:     kt,
+		principals: principals,
+		clockSkew:  defaultClockSkew,
+		now:        time.Now,
+		logger:     logger,
+	}
+}
+
+// isPrincipal checks the ticket is for one of the service principals or,
+// if there are none, any host-based service principal in the keytab which is
+// the equivalent of GSSAPIStrictAcceptorCheck=no.
+func isPrincipal(principals []types.PrincipalName, sname types.PrincipalName) bool {
+	if len(principals) == 0 {
+		return len(sname.NameString) == 2 && sname.NameString[0] == "host"
+	}
+
+	for _, principal := range principals {
+		if principal.Equal(sname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validTicket is the equivalent of messages.Ticket.Valid using the provided
+// time.
+func validTicket(tkt *messages.Ticket, now time.Time, skew time.Duration) error {
+	if tkt.DecryptedEncPart.StartTime.Sub(now) > skew || types.IsFlagSet(&tkt.DecryptedEncPart.Flags, ianaflags.Invalid) {
+		return messages.NewKRBError(tkt.SName, tkt.Realm, errorcode.KRB_AP_ERR_TKT_NYV,
+			"service ticket provided is not yet valid")
+	}
+
+	if now.Sub(tkt.DecryptedEncPart.EndTime) > skew {
+		return messages.NewKRBError(tkt.SName, tkt.Realm, errorcode.KRB_AP_ERR_TKT_EXPIRED,
+			"service ticket provided has expired")
+	}
+
+	return nil
+}
+
+//nolint:cyclop
+func verifyAPReq(apreq *messages.APReq, kt *keytab.Keytab, now time.Time, skew time.Duration,
+	principals []types.PrincipalName) error {
+	if !isPrincipal(principals, apreq.Ticket.SName) {
+		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
+			errorcode.KRB_AP_ERR_NOT_US, "ticket is not for an accepted service principal")
+	}
+
+	err := apreq.Ticket.DecryptEncPart(kt, nil)
+
+	if _, ok := err.(messages.KRBError); ok { //nolint:errorlint
+		return err
+	} else if err != nil {
+		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
+			errorcode.KRB_AP_ERR_BAD_INTEGRITY, "could not decrypt ticket")
+	}
+
+	if err := validTicket(&apreq.Ticket, now, skew); err != nil {
+		return err
+	}
+
+	if err := apreq.DecryptAuthenticator(apreq.Ticket.DecryptedEncPart.Key); err != nil {
+		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
+			errorcode.KRB_AP_ERR_BAD_INTEGRITY, "could not decrypt authenticator")
+	}
+
+	if !apreq.Authenticator.CName.Equal(apreq.Ticket.DecryptedEncPart.CName) {
+		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
+			errorcode.KRB_AP_ERR_BADMATCH, "CName in Authenticator does not match that in service ticket")
+	}
+
+	if now.Sub(
+		apreq.Authenticator.CTime.Add(
+			time.Duration(apreq.Authenticator.Cusec)*time.Microsecond)).Abs() > skew {
+		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
+			errorcode.KRB_AP_ERR_SKEW, fmt.Sprintf("clock skew with client too large, greater than %v seconds", skew))
+	}
+
+	if apreq.Authenticator.Cksum.CksumType != chksumtype.GSSAPI ||
+		len(apreq.Authenticator.Cksum.Checksum) < checksumLength {
+		return errInvalidChecksum
+	}
+
+	return nil
+}
+
+func getAPRepMessage(tkt messages.Ticket, key types.EncryptionKey, ctime time.Time, cusec int) (*apRep, uint64, error) {
+	seq, err := rand.Int(rand.Reader, big.NewInt(math.MaxUint32))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seqNum := seq.Int64() & 0x3fffffff
+
+	encPart := encAPRepPart{
+		CTime:          ctime,
+		Cusec:          cusec,
+		SequenceNumber: seqNum,
+	}
+
+	aprep, err := newAPRep(tkt, key, encPart)
+	if err != nil {
+		return nil, 0, fmt.Errorf("gssapi: %w", err)
+	}
+
+	return &aprep, uint64(seqNum), nil //nolint:gosec
+}
+
+// delegatedCredentials extracts any KRB-CRED message carried in the
+// authenticator checksum as described in RFC 4121 section 4.1.1.1.
+func delegatedCredentials(apreq *messages.APReq, peerSubkey types.EncryptionKey) (*credentials.CCache, error) {
+	checksum := apreq.Authenticator.Cksum.Checksum
+
+	if binary.LittleEndian.Uint32(checksum[20:24])&gssapi.ContextFlagDeleg == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	if len(checksum) < checksumDelegPart ||
+		binary.LittleEndian.Uint16(checksum[24:26]) != checksumDelegOpt {
+		return nil, errInvalidChecksum
+	}
+
+	length := int(binary.LittleEndian.Uint16(checksum[26:28]))
+	if len(checksum) < checksumDelegPart+length {
+		return nil, errInvalidChecksum
+	}
+
+	var cred messages.KRBCred
+	if err := cred.Unmarshal(checksum[checksumDelegPart : checksumDelegPart+length]); err != nil {
+		return nil, err
+	}
+
+	// Some implementations send the KRB-CRED unencrypted, otherwise try
+	// the authenticator subkey before falling back to the session key
+	switch {
+	case cred.EncPart.EType == 0:
+		if err := cred.DecryptedEncPart.Unmarshal(cred.EncPart.Cipher); err != nil {
+			return nil, err
+		}
+	case peerSubkey.KeyType != 0 && cred.DecryptEncPart(peerSubkey) == nil:
+	default:
+		if err := cred.DecryptEncPart(apreq.Ticket.DecryptedEncPart.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	return newCCacheFromKRBCred(&cred)
+}
+
+// verify verifies the AP-REQ, reloading the keytab and trying again if it
+// doesn't contain the key used to encrypt the ticket, such as after the key
+// has been rotated.
+func (ctx *acceptor) verify(apreq *messages.APReq) error {
+	err := verifyAPReq(apreq, ctx.keytab, ctx.now().UTC(), ctx.clockSkew, ctx.principals)
+
+	var krbError messages.KRBError
+	if ctx.reload == nil || !errors.As(err, &krbError) || krbError.ErrorCode != errorcode.KRB_AP_ERR_NOKEY {
+		return err
+	}
+
+	kt, reloadErr := ctx.reload()
+	if reloadErr != nil || kt == ctx.keytab {
+		return err
+	}
+
+	ctx.logger.Info("retrying with reloaded keytab", "kvno", apreq.Ticket.EncPart.KVNO)
+
+	ctx.keytab = kt
+
+	return verifyAPReq(apreq, ctx.keytab, ctx.now().UTC(), ctx.clockSkew, ctx.principals)
+}
+
+// backendAuditReason returns the reason for an error from the acceptor,
+// usually a KRB-ERROR that was sent to the initiator.
+func backendAuditReason(err error) AuditReason {
+	var krbError messages.KRBError
+	if !errors.As(err, &krbError) {
+		if errors.Is(err, errNotAPReq) || errors.Is(err, errInvalidChecksum) {
+			return ReasonMalformedToken
+		}
+
+		return ReasonOther
+	}
+
+	switch krbError.ErrorCode {
+	case errorcode.KRB_AP_ERR_NOT_US:
+		return ReasonWrongPrincipal
+	case errorcode.KRB_AP_ERR_NOKEY, errorcode.KRB_AP_ERR_BADKEYVER:
+		return ReasonUnknownKVNO
+	case errorcode.KRB_AP_ERR_BAD_INTEGRITY, errorcode.KRB_AP_ERR_BADMATCH:
+		return ReasonBadIntegrity
+	case errorcode.KRB_AP_ERR_TKT_NYV:
+		return ReasonTicketNotYetValid
+	case errorcode.KRB_AP_ERR_TKT_EXPIRED:
+		return ReasonTicketExpired
+	case errorcode.KRB_AP_ERR_SKEW:
+		return ReasonClockSkew
+	case errorcode.KRB_AP_ERR_MODIFIED:
+		return ReasonInvalidPAC
+	}
+
+	return ReasonOther
+}
+
+// logWriter adapts a logr.Logger for the log.Logger used by gokrb5.
+type logWriter struct {
+	logger logr.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSpace(string(p)))
+
+	return len(p), nil
+}
+
+// verifyPAC verifies the signature of any PAC in the ticket using the
+// service key and decodes the logon information. An invalid PAC is only
+// rejected if the logon information is required, otherwise it is ignored.
+func (ctx *acceptor) verifyPAC(apreq *messages.APReq) error {
+	ctx.logonInfo = nil
+
+	principal := apreq.Ticket.DecryptedEncPart.CName.PrincipalNameString()
+
+	ok, p, err := apreq.Ticket.GetPACType(ctx.keytab, &apreq.Ticket.SName, log.New(logWriter{ctx.logger}, "", 0))
+	if !ok {
+		return nil
+	}
+
+	// gokrb5 can't verify a PAC without logon information, which MIT krb5
+	// 1.20 onwards doesn't include by default, but then nothing from it is
+	// used anyway
+	if !slices.ContainsFunc(p.Buffers, func(buf pac.InfoBuffer) bool {
+		return buf.ULType == pacLogonInfo
+	}) {
+		ctx.logger.V(1).Info("ignoring PAC without logon information", "principal", principal)
+
+		return nil
+	}
+
+	if err != nil {
+		if !ctx.requirePAC {
+			ctx.logger.Info("ignoring invalid PAC", "principal", principal, "reason", err.Error())
+
+			return nil
+		}
+
+		ctx.logger.Info("invalid PAC", "principal", principal, "reason", err.Error())
+
+		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
+			errorcode.KRB_AP_ERR_MODIFIED, "could not verify PAC")
+	}
+
+	ctx.logonInfo = newLogonInfo(&p)
+
+	return nil
+}
+
+func newLogonInfo(p *pac.PACType) *LogonInfo {
+	info := p.KerbValidationInfo
+	domainSID := info.LogonDomainID.String()
+
+	l := &LogonInfo{
+		Username:        info.EffectiveName.Value,
+		FullName:        info.FullName.Value,
+		Domain:          info.LogonDomainName.Value,
+		DomainSID:       domainSID,
+		UserSID:         fmt.Sprintf("%s-%d", domainSID, info.UserID),
+		PrimaryGroupSID: fmt.Sprintf("%s-%d", domainSID, info.PrimaryGroupID),
+		GroupSIDs:       info.GetGroupMembershipSIDs(),
+		LogonServer:     info.LogonServer.Value,
+	}
+
+	if p.UPNDNSInfo != nil {
+		l.UPN = p.UPNDNSInfo.UPN
+		l.DNSDomain = p.UPNDNSInfo.DNSDomain
+	}
+
+	return l
+}
+
+// checkReplay records the authenticator in the replay cache. It remains
+// there until the authenticator would be rejected for being outside of the
+// allowed clock skew.
+func (ctx *acceptor) checkReplay(apreq *messages.APReq) error {
+	sum := sha256.Sum256(apreq.EncryptedAuthenticator.Cipher)
+
+	expires := apreq.Authenticator.CTime.Add(
+		time.Duration(apreq.Authenticator.Cusec)*time.Microsecond + ctx.clockSkew)
+
+	if err := ctx.replayCache.Add(hex.EncodeToString(sum[:]), ctx.now(), expires); err != nil {
+		if errors.Is(err, ErrReplay) {
+			ctx.logger.Info("replayed authenticator",
+				"principal", apreq.Ticket.DecryptedEncPart.CName.PrincipalNameString())
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func newTicketPeerInfo(principal string, tkt *messages.Ticket, delegated bool, logonInfo *LogonInfo) *PeerInfo {
+	p := newPeerInfo(principal)
+
+	p.AuthTime = tkt.DecryptedEncPart.AuthTime
+	p.StartTime = tkt.DecryptedEncPart.StartTime
+	p.EndTime = tkt.DecryptedEncPart.EndTime
+
+	// The start time is optional and defaults to the auth time
+	if p.StartTime.IsZero() {
+		p.StartTime = p.AuthTime
+	}
+
+	p.EncType = tkt.DecryptedEncPart.Key.KeyType
+
+	flags := make([]byte, 4)
+	copy(flags, tkt.DecryptedEncPart.Flags.Bytes)
+	p.Flags = binary.BigEndian.Uint32(flags)
+
+	p.Delegated = delegated
+	p.LogonInfo = logonInfo
+
+	return p
+}
+
+// accept responds to the token from the initiator, returning a token to be
+// sent back to the initiator and whether another round is required.
+//
+//nolint:cyclop,funlen
+func (ctx *acceptor) accept(input []byte) ([]byte, bool, error) {
+	if ctx.established {
+		return nil, false, nil
+	}
+
+	ctx.krbError = nil
+	ctx.peerName = ""
+
+	var apreq spnego.KRB5Token
+	if err := apreq.Unmarshal(input); err != nil {
+		return nil, false, err
+	}
+
+	if apreq.IsKRBError() {
+		return nil, false, errKRBError
+	}
+
+	if !apreq.IsAPReq() {
+		return nil, false, errNotAPReq
+	}
+
+	var (
+		output []byte
+		err    error
+	)
+
+	err = ctx.verify(&apreq.APReq)
+
+	// Once the ticket is decrypted the principal is known even if the
+	// AP-REQ is then rejected, so it can be throttled and any failure
+	// recorded against it
+	if tkt := apreq.APReq.Ticket.DecryptedEncPart; tkt.CRealm != "" {
+		ctx.peerName = fmt.Sprintf("%s@%s", tkt.CName.PrincipalNameString(), tkt.CRealm)
+
+		if ctx.throttle != nil {
+			if throttleErr := ctx.throttle.check(ctx.peerName, nil, ctx.now()); throttleErr != nil {
+				return nil, false, throttleErr
+			}
+		}
+	}
+
+	if err == nil {
+		err = ctx.verifyPAC(&apreq.APReq)
+	}
+
+	if err != nil {
+		var krbError messages.KRBError
+
+		if errors.As(err, &krbError) {
+			m := newKRB5TokenKRBError(&krbError)
+
+			if output, err = m.marshal(); err == nil {
+				// Remember the error as it's only sent to the initiator
+				ctx.krbError = krbError
+
+				return output, true, nil
+			}
+		}
+
+		return nil, false, err
+	}
+
+	if ctx.replayCache != nil {
+		if err = ctx.checkReplay(&apreq.APReq); err != nil {
+			return nil, false, err
+		}
+	}
+
+	ctx.baseSequenceNumber = uint64(apreq.APReq.Authenticator.SeqNumber) //nolint:gosec
+
+	ctx.ctime = apreq.APReq.Authenticator.CTime
+	ctx.cusec = apreq.APReq.Authenticator.Cusec
+
+	ctx.key = apreq.APReq.Ticket.DecryptedEncPart.Key
+
+	if apreq.APReq.Authenticator.SubKey.KeyType != 0 {
+		ctx.peerSubkey = apreq.APReq.Authenticator.SubKey
+	}
+
+	ctx.flags = int(supportedFlags & binary.LittleEndian.Uint32(apreq.APReq.Authenticator.Cksum.Checksum[20:24]))
+
+	ctx.expiry = apreq.APReq.Ticket.DecryptedEncPart.EndTime
+
+	ctx.servicePrincipal = fmt.Sprintf("%s@%s", apreq.APReq.Ticket.SName.PrincipalNameString(),
+		apreq.APReq.Ticket.Realm)
+
+	ctx.logger.Info("accepted service principal", "principal", ctx.peerName, "service", ctx.servicePrincipal)
+
+	if ctx.delegated, err = delegatedCredentials(&apreq.APReq, ctx.peerSubkey); err != nil {
+		return nil, false, err
+	}
+
+	if ctx.delegated != nil {
+		ctx.logger.Info("received delegated credentials", "principal", ctx.peerName)
+	}
+
+	ctx.peerInfo = newTicketPeerInfo(ctx.peerName, &apreq.APReq.Ticket, ctx.delegated != nil, ctx.logonInfo)
+
+	if types.IsFlagSet(&apreq.APReq.APOptions, ianaflags.APOptionMutualRequired) {
+		var aprep *apRep
+
+		aprep, ctx.sequenceNumber, err = getAPRepMessage(apreq.APReq.Ticket, ctx.key,
+			ctx.ctime, ctx.cusec)
+		if err != nil {
+			return nil, false, err
+		}
+
+		m := newKRB5TokenAPREP(aprep)
+
+		output, err = m.marshal()
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		ctx.sequenceNumber = ctx.baseSequenceNumber
+	}
+
+	ctx.established = true
+
+	return output, false, nil
+}
@@ -0,0 +1,474 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const ccacheVersion = 4
+
+var (
+	errMalformedKRBCred = errors.New("malformed KRB-CRED")
+	errNoTGT            = errors.New("no valid TGT")
+)
+
+// ccacheWriter serialises credentials using version 4 of the MIT file
+// credentials cache format as github.com/jcmturner/gokrb5/v8 can only read
+// them.
+type ccacheWriter struct {
+	bytes.Buffer
+}
+
+func (w *ccacheWriter) writeUint16(v uint16) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *ccacheWriter) writeUint32(v uint32) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *ccacheWriter) writeData(b []byte) {
+	w.writeUint32(uint32(len(b))) //nolint:gosec
+	_, _ = w.Write(b)
+}
+
+func (w *ccacheWriter) writeTime(t time.Time) {
+	if t.IsZero() {
+		w.writeUint32(0)
+
+		return
+	}
+
+	w.writeUint32(uint32(t.Unix())) //nolint:gosec
+}
+
+func (w *ccacheWriter) writePrincipal(realm string, name types.PrincipalName) {
+	w.writeUint32(uint32(name.NameType))        //nolint:gosec
+	w.writeUint32(uint32(len(name.NameString))) //nolint:gosec
+	w.writeData([]byte(realm))
+
+	for _, component := range name.NameString {
+		w.writeData([]byte(component))
+	}
+}
+
+func (w *ccacheWriter) writeCredential(cred *credentials.Credential) {
+	w.writePrincipal(cred.Client.Realm, cred.Client.PrincipalName)
+	w.writePrincipal(cred.Server.Realm, cred.Server.PrincipalName)
+
+	w.writeUint16(uint16(cred.Key.KeyType)) //nolint:gosec
+	w.writeData(cred.Key.KeyValue)
+
+	w.writeTime(cred.AuthTime)
+	w.writeTime(cred.StartTime)
+	w.writeTime(cred.EndTime)
+	w.writeTime(cred.RenewTill)
+
+	if cred.IsSKey {
+		_ = w.WriteByte(1)
+	} else {
+		_ = w.WriteByte(0)
+	}
+
+	flags := make([]byte, 4)
+	copy(flags, cred.TicketFlags.Bytes)
+	_, _ = w.Write(flags)
+
+	w.writeUint32(uint32(len(cred.Addresses))) //nolint:gosec
+
+	for _, address := range cred.Addresses {
+		w.writeUint16(uint16(address.AddrType)) //nolint:gosec
+		w.writeData(address.Address)
+	}
+
+	w.writeUint32(uint32(len(cred.AuthData))) //nolint:gosec
+
+	for _, entry := range cred.AuthData {
+		w.writeUint16(uint16(entry.ADType)) //nolint:gosec
+		w.writeData(entry.ADData)
+	}
+
+	w.writeData(cred.Ticket)
+	w.writeData(cred.SecondTicket)
+}
+
+// marshalCCache returns the credentials cache in the MIT file format.
+func marshalCCache(ccache *credentials.CCache) []byte {
+	w := new(ccacheWriter)
+
+	_, _ = w.Write([]byte{5, ccacheVersion})
+
+	// No header fields
+	w.writeUint16(0)
+
+	w.writePrincipal(ccache.DefaultPrincipal.Realm, ccache.DefaultPrincipal.PrincipalName)
+
+	for _, cred := range ccache.Credentials {
+		w.writeCredential(cred)
+	}
+
+	return w.Bytes()
+}
+
+// newCCacheFromKRBCred converts a decrypted KRB-CRED message into a
+// credentials cache with the first client principal as the default.
+func newCCacheFromKRBCred(cred *messages.KRBCred) (*credentials.CCache, error) {
+	info := cred.DecryptedEncPart.TicketInfo
+	if len(info) == 0 || len(info) != len(cred.Tickets) {
+		return nil, errMalformedKRBCred
+	}
+
+	ccache := &credentials.CCache{
+		Version: ccacheVersion,
+	}
+
+	for i := range info {
+		if info[i].PRealm == "" || len(info[i].PName.NameString) == 0 {
+			return nil, errMalformedKRBCred
+		}
+
+		ticket, err := cred.Tickets[i].Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		c := &credentials.Credential{
+			Key:         info[i].Key,
+			AuthTime:    info[i].AuthTime,
+			StartTime:   info[i].StartTime,
+			EndTime:     info[i].EndTime,
+			RenewTill:   info[i].RenewTill,
+			TicketFlags: info[i].Flags,
+			Addresses:   info[i].CAddr,
+			Ticket:      ticket,
+		}
+
+		c.Client.Realm = info[i].PRealm
+		c.Client.PrincipalName = info[i].PName
+
+		c.Server.Realm = info[i].SRealm
+		if c.Server.Realm == "" {
+			c.Server.Realm = cred.Tickets[i].Realm
+		}
+
+		c.Server.PrincipalName = info[i].SName
+		if len(c.Server.PrincipalName.NameString) == 0 {
+			c.Server.PrincipalName = cred.Tickets[i].SName
+		}
+
+		if i == 0 {
+			ccache.DefaultPrincipal = c.Client
+		}
+
+		ccache.Credentials = append(ccache.Credentials, c)
+	}
+
+	return ccache, nil
+}
+
+// writeCCacheFile writes the credentials cache to a new file in dir that is
+// only accessible by the current user.
+func writeCCacheFile(ccache *credentials.CCache, dir string, logger logr.Logger) (*CCacheFile, error) {
+	file, err := os.CreateTemp(dir, "krb5cc_")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &CCacheFile{
+		path:   file.Name(),
+		logger: logger,
+	}
+
+	if err = file.Chmod(0o600); err == nil {
+		_, err = file.Write(marshalCCache(ccache))
+	}
+
+	if err = multierror.Append(err, file.Close()).ErrorOrNil(); err != nil {
+		return nil, multierror.Append(err, f.Destroy()).ErrorOrNil()
+	}
+
+	logger.Info("wrote credentials cache", "path", f.path)
+
+	return f, nil
+}
+
+// newCredential returns the credential for a ticket issued by the KDC.
+func newCredential(crealm string, cname types.PrincipalName, ticket messages.Ticket,
+	part messages.EncKDCRepPart) (*credentials.Credential, error) {
+	b, err := ticket.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &credentials.Credential{
+		Key:         part.Key,
+		AuthTime:    part.AuthTime,
+		StartTime:   part.StartTime,
+		EndTime:     part.EndTime,
+		RenewTill:   part.RenewTill,
+		TicketFlags: part.Flags,
+		Addresses:   part.CAddr,
+		Ticket:      b,
+	}
+
+	c.Client.Realm = crealm
+	c.Client.PrincipalName = cname
+
+	c.Server.Realm = part.SRealm
+	c.Server.PrincipalName = part.SName
+
+	return c, nil
+}
+
+// loadStoredCCache loads the stored credentials cache if it has a valid TGT
+// for the principal, otherwise it logs in to get a new one.
+func (c *Client) loadStoredCCache() error {
+	if c.storeCCache == "" {
+		return c.login(nil)
+	}
+
+	path := strings.TrimPrefix(c.storeCCache, krb5FilePrefix)
+
+	cache, err := credentials.LoadCCache(path)
+
+	switch {
+	case err == nil && checkCCachePrincipal(cache, c.username+"@"+c.domain) == nil:
+		// Any service tickets are kept even if the TGT has expired
+		c.stored = cache
+
+		if _, ok := c.storedTGT(); ok {
+			c.logger.Info("using stored credentials cache", "path", path)
+
+			return nil
+		}
+	case err != nil && !os.IsNotExist(err):
+		c.logger.Error(err, "unable to load stored credentials cache", "path", path)
+	}
+
+	if err = c.login(nil); err != nil {
+		return err
+	}
+
+	return c.writeStoredCCache()
+}
+
+// login requests a new TGT and adds it to the stored credentials cache,
+// replacing tgt which is the TGT the caller found, if any. Concurrent logins
+// are collapsed into one so if tgt has already been replaced by a valid TGT
+// nothing is requested. It must be called without the lock held.
+func (c *Client) login(tgt *credentials.Credential) error {
+	c.loginMu.Lock()
+	defer c.loginMu.Unlock()
+
+	c.mu.Lock()
+	current, ok := c.storedTGT()
+	c.mu.Unlock()
+
+	if ok && current != tgt {
+		return nil
+	}
+
+	cred, err := c.requestTGT()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stored == nil {
+		c.stored = &credentials.CCache{
+			Version:          ccacheVersion,
+			DefaultPrincipal: cred.Client,
+		}
+	}
+
+	creds := make([]*credentials.Credential, 0, len(c.stored.Credentials)+1)
+
+	for _, existing := range c.stored.Credentials {
+		if !existing.Server.PrincipalName.Equal(cred.Server.PrincipalName) {
+			creds = append(creds, existing)
+		}
+	}
+
+	c.stored.Credentials = append(creds, cred)
+
+	return nil
+}
+
+// requestTGT requests a new TGT.
+func (c *Client) requestTGT() (*credentials.Credential, error) {
+	realm, cname := c.client.Credentials.Domain(), c.client.Credentials.CName()
+
+	asReq, err := messages.NewASReqForTGT(realm, c.client.Config, cname)
+	if err != nil {
+		return nil, err
+	}
+
+	asRep, err := c.client.ASExchange(realm, asReq, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	cred, err := newCredential(asRep.CRealm, asRep.CName, asRep.Ticket, asRep.DecryptedEncPart)
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Info("logged in", "principal", cname.PrincipalNameString()+"@"+realm, "until", cred.EndTime)
+
+	return cred, nil
+}
+
+// storedTGT returns the TGT from the stored credentials cache and whether
+// it's still valid. It must be called with the lock held.
+func (c *Client) storedTGT() (*credentials.Credential, bool) {
+	if c.stored == nil {
+		return nil, false
+	}
+
+	realm := c.stored.GetClientRealm()
+
+	cred, ok := c.stored.GetEntry(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm))
+
+	return cred, ok && c.now().Before(cred.EndTime)
+}
+
+// serviceTicket returns a valid service ticket from the stored credentials
+// cache or requests a new one with the stored TGT, which is stored for next
+// time.
+func (c *Client) serviceTicket(spn string) (messages.Ticket, types.EncryptionKey, asn1.BitString, error) {
+	var (
+		ticket messages.Ticket
+		sname  = types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, spn)
+	)
+
+	cred, cached, realm, err := c.lookupServiceTicket(sname)
+	if err != nil {
+		return ticket, types.EncryptionKey{}, asn1.BitString{}, err
+	}
+
+	if err = ticket.Unmarshal(cred.Ticket); err != nil {
+		return ticket, types.EncryptionKey{}, asn1.BitString{}, err
+	}
+
+	if cached {
+		return ticket, cred.Key, cred.TicketFlags, nil
+	}
+
+	// The TGS exchange is done without the lock held so other connections
+	// aren't held up waiting for the KDC
+	_, tgsRep, err := c.client.TGSREQGenerateAndExchange(sname, realm, ticket, cred.Key, false)
+	if err != nil {
+		return ticket, types.EncryptionKey{}, asn1.BitString{}, err
+	}
+
+	if cred, err = newCredential(tgsRep.CRealm, tgsRep.CName, tgsRep.Ticket, tgsRep.DecryptedEncPart); err != nil {
+		return ticket, types.EncryptionKey{}, asn1.BitString{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	creds := make([]*credentials.Credential, 0, len(c.stored.Credentials)+1)
+
+	for _, existing := range c.stored.Credentials {
+		if !existing.Server.PrincipalName.Equal(sname) {
+			creds = append(creds, existing)
+		}
+	}
+
+	c.stored.Credentials = append(creds, cred)
+
+	// The ticket can still be used even if it can't be stored
+	if err = c.writeStoredCCache(); err != nil {
+		c.logger.Error(err, "unable to store service ticket", "spn", spn)
+	}
+
+	return tgsRep.Ticket, tgsRep.DecryptedEncPart.Key, tgsRep.DecryptedEncPart.Flags, nil
+}
+
+// lookupServiceTicket returns a valid cached service ticket for sname if
+// there is one. Otherwise it returns the TGT, logging in first if necessary,
+// along with the client realm.
+func (c *Client) lookupServiceTicket(sname types.PrincipalName) (*credentials.Credential, bool, string, error) {
+	c.mu.Lock()
+
+	if cred, ok := c.stored.GetEntry(sname); ok && c.now().Before(cred.EndTime) {
+		c.mu.Unlock()
+
+		return cred, true, "", nil
+	}
+
+	tgt, ok := c.storedTGT()
+	realm := c.stored.GetClientRealm()
+	c.mu.Unlock()
+
+	if ok {
+		return tgt, false, realm, nil
+	}
+
+	if !c.canLogin() {
+		return nil, false, "", errNoTGT
+	}
+
+	// As with the TGS exchange the AS exchange is done without the lock
+	// held
+	if err := c.login(tgt); err != nil {
+		return nil, false, "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tgt, _ = c.storedTGT()
+
+	return tgt, false, c.stored.GetClientRealm(), nil
+}
+
+// writeStoredCCache atomically replaces the stored credentials cache with
+// a file that is only accessible by the current user, if there is one.
+func (c *Client) writeStoredCCache() error {
+	if c.storeCCache == "" {
+		return nil
+	}
+
+	path := strings.TrimPrefix(c.storeCCache, krb5FilePrefix)
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	if err = file.Chmod(0o600); err == nil {
+		_, err = file.Write(marshalCCache(c.stored))
+	}
+
+	if err = multierror.Append(err, file.Close()).ErrorOrNil(); err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		return multierror.Append(err, os.Remove(file.Name())).ErrorOrNil()
+	}
+
+	c.logger.V(1).Info("stored credentials cache", "path", path)
+
+	return nil
+}
@@ -0,0 +1,205 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"errors"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+var errNotForwardable = errors.New("TGT is not forwardable")
+
+// marshalKRBCred is the KRB-CRED message, which gokrb5 can only unmarshal.
+type marshalKRBCred struct {
+	PVNO    int                 `asn1:"explicit,tag:0"`
+	MsgType int                 `asn1:"explicit,tag:1"`
+	Tickets asn1.RawValue       `asn1:"explicit,tag:2"`
+	EncPart types.EncryptedData `asn1:"explicit,tag:3"`
+}
+
+// forwardCredentials returns a KRB-CRED message containing a forwarded TGT
+// encrypted with the session key for the service, or nil if credentials
+// shouldn't or can't be delegated to it. ticketFlags are the flags of the
+// service ticket that was just obtained, the stored credentials cache may
+// have been replaced since. Failing to delegate is logged rather than failing
+// the authentication.
+func (c *Client) forwardCredentials(spn string, key types.EncryptionKey, ticketFlags asn1.BitString) ([]byte, error) {
+	if c.delegation == DelegateOKAsDelegate && !isFlagSet(ticketFlags, flags.OKAsDelegate) {
+		c.logger.Info("not delegating credentials as the service ticket isn't ok-as-delegate", "spn", spn)
+
+		return nil, nil //nolint:nilnil
+	}
+
+	c.mu.Lock()
+
+	tgt, ok := c.storedTGT()
+	if !ok {
+		c.mu.Unlock()
+
+		return nil, errNoTGT
+	}
+
+	cname, realm := c.stored.GetClientPrincipalName(), c.stored.GetClientRealm()
+	c.mu.Unlock()
+
+	if !types.IsFlagSet(&tgt.TicketFlags, flags.Forwardable) {
+		c.logger.Error(errNotForwardable, "not delegating credentials", "spn", spn)
+
+		return nil, nil //nolint:nilnil
+	}
+
+	tgsRep, err := c.forwardedTGT(tgt, cname, realm)
+	if err != nil {
+		c.logger.Error(err, "not delegating credentials as a forwarded TGT couldn't be obtained", "spn", spn)
+
+		return nil, nil //nolint:nilnil
+	}
+
+	c.logger.V(1).Info("delegating credentials", "spn", spn)
+
+	return newKRBCred(tgsRep, key)
+}
+
+// forwardedTGT requests a forwarded copy of the TGT without any addresses
+// so that it can be used by the service.
+func (c *Client) forwardedTGT(tgt *credentials.Credential, cname types.PrincipalName,
+	realm string) (messages.TGSRep, error) {
+	var ticket messages.Ticket
+	if err := ticket.Unmarshal(tgt.Ticket); err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	tgsReq, err := messages.NewTGSReq(cname, realm, c.client.Config, ticket, tgt.Key, tgt.Server.PrincipalName, false)
+	if err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	types.SetFlag(&tgsReq.ReqBody.KDCOptions, flags.Forwarded)
+	tgsReq.ReqBody.Addresses = nil
+
+	// The request body has changed so the authenticator checksum must be
+	// recalculated
+	if err = setTGSReqPAData(&tgsReq, ticket, tgt.Key); err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	_, tgsRep, err := c.client.TGSExchange(tgsReq, realm, ticket, tgt.Key, 0)
+
+	return tgsRep, err
+}
+
+// setTGSReqPAData sets the PA-TGS-REQ containing the TGT and an
+// authenticator with a checksum of the request body.
+func setTGSReqPAData(tgsReq *messages.TGSReq, tgt messages.Ticket, key types.EncryptionKey) error {
+	b, err := tgsReq.ReqBody.Marshal()
+	if err != nil {
+		return err
+	}
+
+	etype, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := etype.GetChecksumHash(key.KeyValue, b, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM)
+	if err != nil {
+		return err
+	}
+
+	auth, err := types.NewAuthenticator(tgt.Realm, tgsReq.ReqBody.CName)
+	if err != nil {
+		return err
+	}
+
+	auth.Cksum = types.Checksum{
+		CksumType: etype.GetHashID(),
+		Checksum:  checksum,
+	}
+
+	apReq, err := messages.NewAPReq(tgt, key, auth)
+	if err != nil {
+		return err
+	}
+
+	if b, err = apReq.Marshal(); err != nil {
+		return err
+	}
+
+	tgsReq.PAData = types.PADataSequence{
+		{
+			PADataType:  patype.PA_TGS_REQ,
+			PADataValue: b,
+		},
+	}
+
+	return nil
+}
+
+// newKRBCred returns a KRB-CRED message containing the ticket from the
+// TGS-REP encrypted with the key, as described in RFC 4120 section 3.6.
+func newKRBCred(tgsRep messages.TGSRep, key types.EncryptionKey) ([]byte, error) {
+	part := tgsRep.DecryptedEncPart
+
+	b, err := asn1.Marshal(messages.EncKrbCredPart{
+		TicketInfo: []messages.KrbCredInfo{
+			{
+				Key:       part.Key,
+				PRealm:    tgsRep.CRealm,
+				PName:     tgsRep.CName,
+				Flags:     part.Flags,
+				AuthTime:  part.AuthTime,
+				StartTime: part.StartTime,
+				EndTime:   part.EndTime,
+				RenewTill: part.RenewTill,
+				SRealm:    part.SRealm,
+				SName:     part.SName,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encPart, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(b, asnAppTag.EncKrbCredPart), key,
+		keyusage.KRB_CRED_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tickets, err := messages.MarshalTicketSequence([]messages.Ticket{tgsRep.Ticket})
+	if err != nil {
+		return nil, err
+	}
+
+	tickets.Tag = 2
+
+	if b, err = asn1.Marshal(marshalKRBCred{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_CRED,
+		Tickets: tickets,
+		EncPart: encPart,
+	}); err != nil {
+		return nil, err
+	}
+
+	return asn1tools.AddASNAppTag(b, asnAppTag.KRBCred), nil
+}
+
+// isFlagSet is types.IsFlagSet but treats flags that are too short as unset
+// rather than panicking.
+func isFlagSet(f asn1.BitString, flag int) bool {
+	return len(f.Bytes) > flag/8 && types.IsFlagSet(&f, flag)
+}
@@ -0,0 +1,30 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import "github.com/jcmturner/gokrb5/v8/credentials"
+
+// ClientPrincipal returns the principal the Client authenticates as.
+func ClientPrincipal(c *Client) string {
+	return c.client.Credentials.CName().PrincipalNameString() + "@" + c.client.Credentials.Realm()
+}
+
+// ForwardCredentialsAfterLogin obtains a service ticket for spn and then
+// forwards credentials to it after replacing the stored credentials cache
+// with one holding only the TGT, as a concurrent login could.
+func ForwardCredentialsAfterLogin(c *Client, spn string) ([]byte, error) {
+	_, key, ticketFlags, err := c.serviceTicket(spn)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	tgt, _ := c.storedTGT()
+	stored := *c.stored
+	stored.Credentials = []*credentials.Credential{tgt}
+	c.stored = &stored
+	c.mu.Unlock()
+
+	return c.forwardCredentials(spn, key, ticketFlags)
+}
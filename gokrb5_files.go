@@ -0,0 +1,185 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+const (
+	krb5FilePrefix   = "FILE:"
+	krb5DirPrefix    = "DIR:"
+	krb5Config       = "KRB5_CONFIG"
+	krb5CCName       = "KRB5CCNAME"
+	krb5KTName       = "KRB5_KTNAME"
+	krb5ClientKTName = "KRB5_CLIENT_KTNAME"
+)
+
+var errNoCCache = errors.New("no credentials cache for principal")
+
+func findFile(logger logr.Logger, env string, try []string) (string, error) {
+	logger.Info("looking for file", "env", env, "paths", try)
+
+	path, ok := os.LookupEnv(env)
+	if ok {
+		path = strings.TrimPrefix(path, krb5FilePrefix)
+
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("%s: %w", env, err)
+		}
+
+		return path, nil
+	}
+
+	errs := fmt.Errorf("%s: not found", env) //nolint:err113
+
+	for _, t := range try {
+		if _, err := os.Stat(t); err != nil {
+			errs = multierror.Append(errs, err)
+
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return "", errs
+		}
+
+		return t, nil
+	}
+
+	return "", errs
+}
+
+func findKeytab(logger logr.Logger, path string) (string, error) {
+	if path != "" {
+		return strings.TrimPrefix(path, krb5FilePrefix), nil
+	}
+
+	return findFile(logger, krb5KTName, []string{"/etc/krb5.keytab"})
+}
+
+func loadConfig(logger logr.Logger) (*config.Config, error) {
+	path, err := findFile(logger, krb5Config, []string{"/etc/krb5.conf"})
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Load(path)
+}
+
+// loadCCache loads the named credentials cache, or the default if there's
+// no name. If principal is set then the credentials cache must be for it.
+func loadCCache(logger logr.Logger, name, principal string) (*credentials.CCache, error) {
+	if name == "" {
+		if env := os.Getenv(krb5CCName); strings.HasPrefix(env, krb5DirPrefix) {
+			name = env
+		} else {
+			path, err := findFile(logger, krb5CCName, []string{fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())})
+			if err != nil {
+				return nil, err
+			}
+
+			name = path
+		}
+	}
+
+	if dir, ok := strings.CutPrefix(name, krb5DirPrefix); ok {
+		// DIR::path names a single credentials cache in a collection
+		path, ok := strings.CutPrefix(dir, ":")
+		if !ok {
+			return loadCCacheCollection(logger, dir, principal)
+		}
+
+		name = path
+	} else if typ, _, ok := strings.Cut(name, ":"); ok && typ+":" != krb5FilePrefix && !strings.Contains(typ, "/") {
+		return nil, fmt.Errorf("%w: %s credentials cache", errNotSupported, typ)
+	}
+
+	cache, err := credentials.LoadCCache(strings.TrimPrefix(name, krb5FilePrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, checkCCachePrincipal(cache, principal)
+}
+
+// loadCCacheCollection loads the primary credentials cache in a DIR:
+// collection or, if principal is set, the one for the principal.
+func loadCCacheCollection(logger logr.Logger, dir, principal string) (*credentials.CCache, error) {
+	if principal == "" {
+		primary := "tkt"
+
+		b, err := os.ReadFile(filepath.Join(dir, "primary"))
+		if err == nil {
+			primary = strings.TrimSpace(string(b))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		return credentials.LoadCCache(filepath.Join(dir, primary))
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "tkt*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		cache, err := credentials.LoadCCache(path)
+		if err != nil {
+			logger.Error(err, "unable to load credentials cache", "path", path)
+
+			continue
+		}
+
+		if checkCCachePrincipal(cache, principal) == nil {
+			logger.Info("using credentials cache", "path", path, "principal", principal)
+
+			return cache, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", errNoCCache, principal)
+}
+
+// checkCCachePrincipal checks the credentials cache is for the principal,
+// which matches any realm if it has none.
+func checkCCachePrincipal(cache *credentials.CCache, principal string) error {
+	if principal == "" {
+		return nil
+	}
+
+	components, realm := splitPrincipal(principal)
+	if slices.Equal(components, cache.GetClientPrincipalName().NameString) &&
+		(realm == "" || realm == cache.GetClientRealm()) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", errNoCCache, principal)
+}
+
+func loadClientKeytab(logger logr.Logger, path string) (*keytab.Keytab, error) {
+	if path == "" {
+		var err error
+
+		path, err = findFile(logger, krb5ClientKTName,
+			[]string{fmt.Sprintf("/var/kerberos/krb5/user/%d/client.keytab", os.Geteuid())})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keytab.Load(strings.TrimPrefix(path, krb5FilePrefix))
+}
@@ -0,0 +1,217 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+var (
+	errNotMutual    = errors.New("mutual authentication not requested")
+	errNotAPRep     = errors.New("didn't receive an AP-REP")
+	errMutualFailed = errors.New("mutual authentication failed")
+)
+
+// initiator represents the client side of a single GSSAPI exchange.
+type initiator struct {
+	secContext
+
+	client *client.Client
+	// getServiceTicket returns the service ticket along with its session
+	// key and flags
+	getServiceTicket func(string) (messages.Ticket, types.EncryptionKey, asn1.BitString, error)
+	// forwardCredentials returns the KRB-CRED to delegate to the service,
+	// if any
+	forwardCredentials func(string, types.EncryptionKey, asn1.BitString) ([]byte, error)
+	delegation         []byte
+	now                func() time.Time
+}
+
+func newInitiator(client *client.Client, now func() time.Time) *initiator {
+	return &initiator{
+		secContext: secContext{
+			sequenceMask: math.MaxUint32,
+		},
+		client: client,
+		getServiceTicket: func(spn string) (messages.Ticket, types.EncryptionKey, asn1.BitString, error) {
+			ticket, key, err := client.GetServiceTicket(spn)
+
+			return ticket, key, asn1.BitString{}, err
+		},
+		now: now,
+	}
+}
+
+// newAPReq creates the AP-REQ for the ticket with an authenticator using the
+// time from the clock, as described in RFC 4121 section 4.1.1.
+func (ctx *initiator) newAPReq(ticket messages.Ticket) (*messages.APReq, error) {
+	auth, err := types.NewAuthenticator(ctx.client.Credentials.Domain(), ctx.client.Credentials.CName())
+	if err != nil {
+		return nil, krberror.Errorf(err, krberror.KRBMsgError, "error generating new authenticator")
+	}
+
+	now := ctx.now().UTC()
+
+	auth.CTime = now
+	auth.Cusec = now.Nanosecond() / int(time.Microsecond)
+
+	checksum := make([]byte, checksumLength, checksumDelegPart+len(ctx.delegation))
+	binary.LittleEndian.PutUint32(checksum[:4], 16)
+	binary.LittleEndian.PutUint32(checksum[20:24], uint32(ctx.flags)) //nolint:gosec
+
+	if ctx.delegation != nil {
+		checksum = binary.LittleEndian.AppendUint16(checksum, checksumDelegOpt)
+		checksum = binary.LittleEndian.AppendUint16(checksum, uint16(len(ctx.delegation))) //nolint:gosec
+		checksum = append(checksum, ctx.delegation...)
+	}
+
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  checksum,
+	}
+
+	apreq, err := messages.NewAPReq(ticket, ctx.key, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apreq, nil
+}
+
+// initiate creates a new context targeting the service with the desired
+// flags along with the initial input token, which will initially be nil. The
+// output token is returned and whether another round is required.
+//
+//nolint:cyclop,funlen
+func (ctx *initiator) initiate(service string, flags int, input []byte) ([]byte, bool, error) {
+	if ctx.established {
+		return nil, false, nil
+	}
+
+	var err error
+
+	//nolint:nestif
+	if len(input) == 0 {
+		ctx.flags = flags & supportedFlags
+
+		// BUG(bodgit): see https://github.com/jcmturner/gokrb5/issues/529
+		ctx.expiry = ctx.now().Add(ctx.client.Config.LibDefaults.TicketLifetime)
+
+		var (
+			ticket      messages.Ticket
+			ticketFlags asn1.BitString
+		)
+
+		spn := strings.ReplaceAll(service, "@", "/")
+
+		if ticket, ctx.key, ticketFlags, err = ctx.getServiceTicket(spn); err != nil {
+			return nil, false, err
+		}
+
+		if flags&gssapi.ContextFlagDeleg != 0 && ctx.forwardCredentials != nil {
+			if ctx.delegation, err = ctx.forwardCredentials(spn, ctx.key, ticketFlags); err != nil {
+				return nil, false, err
+			}
+
+			if ctx.delegation != nil {
+				ctx.flags |= gssapi.ContextFlagDeleg
+			}
+		}
+
+		ctx.peerName = fmt.Sprintf("%s@%s", ticket.SName.PrincipalNameString(), ticket.Realm)
+
+		apreq, err := ctx.newAPReq(ticket)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if ctx.doMutual() {
+			types.SetFlag(&apreq.APOptions, ianaflags.APOptionMutualRequired)
+		}
+
+		// Decrypt the authenticator to get the timestamp with the
+		// precision that will be echoed back in the AP-REP
+		if err = apreq.DecryptAuthenticator(ctx.key); err != nil {
+			return nil, false, err
+		}
+
+		ctx.sequenceNumber = uint64(apreq.Authenticator.SeqNumber) //nolint:gosec
+
+		ctx.ctime = apreq.Authenticator.CTime
+		ctx.cusec = apreq.Authenticator.Cusec
+
+		m := newKRB5TokenAPREQ(apreq)
+
+		output, err := m.marshal()
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !ctx.doMutual() {
+			ctx.established = true
+			ctx.baseSequenceNumber = ctx.sequenceNumber
+		}
+
+		return output, true, nil
+	}
+
+	if !ctx.doMutual() {
+		return nil, false, errNotMutual
+	}
+
+	var aprep spnego.KRB5Token
+	if err = aprep.Unmarshal(input); err != nil {
+		return nil, false, err
+	}
+
+	if aprep.IsKRBError() {
+		return nil, false, errKRBError
+	}
+
+	if !aprep.IsAPRep() {
+		return nil, false, errNotAPRep
+	}
+
+	b, err := crypto.DecryptEncPart(aprep.APRep.EncPart, ctx.key, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return nil, false, krberror.Errorf(err, krberror.DecryptingError, "error decrypting AP-REP enc-part")
+	}
+
+	var payload messages.EncAPRepPart
+	if err = payload.Unmarshal(b); err != nil {
+		return nil, false, krberror.Errorf(err, krberror.EncodingError, "error unmarshalling decrypted AP-REP enc-part")
+	}
+
+	ctx.baseSequenceNumber = uint64(payload.SequenceNumber) //nolint:gosec
+
+	if payload.Subkey.KeyType != 0 {
+		ctx.peerSubkey = payload.Subkey
+	}
+
+	// Use Round() to strip off any monotonic clock reading
+	if !ctx.ctime.Round(0).Equal(payload.CTime.UTC()) || ctx.cusec != payload.Cusec {
+		return nil, false, errMutualFailed
+	}
+
+	ctx.established = true
+
+	return nil, false, nil
+}
@@ -0,0 +1,369 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+var (
+	errNoTGSReq       = errors.New("no PA-TGS-REQ")
+	errNotForwardable = errors.New("TGT is not forwardable")
+)
+
+// testKDC is a KDC for the test realm that issues tickets for any principal
+// in its keytab without requiring pre-authentication.
+type testKDC struct {
+	kt       *keytab.Keytab
+	listener net.Listener
+	lifetime time.Duration
+	// renewable is the maximum renewable lifetime, tickets aren't
+	// renewable if it is zero
+	renewable time.Duration
+	// okAsDelegate lists the services with the ok-as-delegate flag set on
+	// their tickets
+	okAsDelegate []string
+
+	mu      sync.Mutex
+	as      int
+	tgs     int
+	renewed int
+	// stalled KDCs hold connections without replying
+	stalled bool
+	held    []net.Conn
+}
+
+func newTestKDC(t *testing.T, kt *keytab.Keytab, users ...string) *testKDC {
+	t.Helper()
+
+	for _, user := range users {
+		if err := kt.AddEntry(user, testRealm, testPassword, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kdc := &testKDC{
+		kt:       kt,
+		listener: listener,
+		lifetime: time.Hour,
+	}
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go kdc.serve()
+
+	return kdc
+}
+
+// config returns a krb5.conf that uses the KDC over TCP.
+func (k *testKDC) config() string {
+	return fmt.Sprintf(`[libdefaults]
+ default_realm = %[1]s
+ udp_preference_limit = 1
+ dns_lookup_kdc = false
+
+[realms]
+ %[1]s = {
+  kdc = %[2]s
+ }
+`, testRealm, k.listener.Addr().String())
+}
+
+func (k *testKDC) counts() (int, int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.as, k.tgs
+}
+
+// stall stops the KDC from replying, as if it's unreachable.
+func (k *testKDC) stall() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.stalled = true
+}
+
+// resume closes any held connections and lets the KDC reply again.
+func (k *testKDC) resume() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, conn := range k.held {
+		_ = conn.Close()
+	}
+
+	k.stalled, k.held = false, nil
+}
+
+// setLifetime changes the lifetime of tickets issued from now on.
+func (k *testKDC) setLifetime(lifetime time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.lifetime = lifetime
+}
+
+// waiting returns the number of requests held by a stalled KDC.
+func (k *testKDC) waiting() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.held)
+}
+
+func (k *testKDC) renewals() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.renewed
+}
+
+func (k *testKDC) serve() {
+	for {
+		conn, err := k.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			k.mu.Lock()
+			stalled := k.stalled
+
+			if stalled {
+				k.held = append(k.held, conn)
+			}
+
+			k.mu.Unlock()
+
+			if stalled {
+				_, _ = io.Copy(io.Discard, conn)
+
+				return
+			}
+
+			var length uint32
+			if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+				return
+			}
+
+			b := make([]byte, length)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+
+			reply, err := k.handle(b)
+			if err != nil {
+				return
+			}
+
+			_ = binary.Write(conn, binary.BigEndian, uint32(len(reply))) //nolint:gosec
+			_, _ = conn.Write(reply)
+		}()
+	}
+}
+
+func (k *testKDC) handle(b []byte) ([]byte, error) {
+	var asReq messages.ASReq
+	if err := asReq.Unmarshal(b); err == nil {
+		return k.handleAS(asReq)
+	}
+
+	var tgsReq messages.TGSReq
+	if err := tgsReq.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	return k.handleTGS(tgsReq)
+}
+
+func (k *testKDC) handleAS(req messages.ASReq) ([]byte, error) {
+	k.mu.Lock()
+	k.as++
+	k.mu.Unlock()
+
+	key, kvno, err := k.kt.GetEncryptionKey(req.ReqBody.CName, req.ReqBody.Realm, 0, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := messages.ASRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:    5,
+			MsgType: msgtype.KRB_AS_REP,
+			CRealm:  req.ReqBody.Realm,
+			CName:   req.ReqBody.CName,
+		},
+	}
+
+	if rep.Ticket, rep.EncPart, err = k.issue(req.ReqBody, req.ReqBody.CName, key, kvno,
+		keyusage.AS_REP_ENCPART, time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return rep.Marshal()
+}
+
+func (k *testKDC) handleTGS(req messages.TGSReq) ([]byte, error) {
+	renew := types.IsFlagSet(&req.ReqBody.KDCOptions, flags.Renew)
+
+	k.mu.Lock()
+	if renew {
+		k.renewed++
+	} else {
+		k.tgs++
+	}
+	k.mu.Unlock()
+
+	var apReq messages.APReq
+
+	for _, pa := range req.PAData {
+		if pa.PADataType == patype.PA_TGS_REQ {
+			if err := apReq.Unmarshal(pa.PADataValue); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(apReq.Ticket.SName.NameString) == 0 {
+		return nil, errNoTGSReq
+	}
+
+	if err := apReq.Ticket.DecryptEncPart(k.kt, nil); err != nil {
+		return nil, err
+	}
+
+	tgt := apReq.Ticket.DecryptedEncPart
+
+	if types.IsFlagSet(&req.ReqBody.KDCOptions, flags.Forwarded) && !types.IsFlagSet(&tgt.Flags, flags.Forwardable) {
+		return nil, errNotForwardable
+	}
+
+	rep := messages.TGSRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:    5,
+			MsgType: msgtype.KRB_TGS_REP,
+			CRealm:  tgt.CRealm,
+			CName:   tgt.CName,
+		},
+	}
+
+	var (
+		renewTill time.Time
+		err       error
+	)
+
+	if renew {
+		renewTill = tgt.RenewTill
+	}
+
+	if rep.Ticket, rep.EncPart, err = k.issue(req.ReqBody, tgt.CName, tgt.Key, 0,
+		keyusage.TGS_REP_ENCPART_SESSION_KEY, renewTill); err != nil {
+		return nil, err
+	}
+
+	return rep.Marshal()
+}
+
+// issue returns a new ticket for the request along with the encrypted part
+// of the reply, encrypted with the key. Renewed tickets keep the renewable
+// lifetime of the original.
+func (k *testKDC) issue(body messages.KDCReqBody, cname types.PrincipalName, key types.EncryptionKey, kvno int,
+	usage uint32, renewTill time.Time) (messages.Ticket, types.EncryptedData, error) {
+	k.mu.Lock()
+	lifetime, renewable := k.lifetime, k.renewable
+	k.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	end := now.Add(lifetime)
+
+	ticketFlags := types.NewKrbFlags()
+	types.SetFlag(&ticketFlags, flags.Initial)
+
+	for _, flag := range []int{flags.Forwardable, flags.Forwarded} {
+		if types.IsFlagSet(&body.KDCOptions, flag) {
+			types.SetFlag(&ticketFlags, flag)
+		}
+	}
+
+	if slices.Contains(k.okAsDelegate, body.SName.PrincipalNameString()) {
+		types.SetFlag(&ticketFlags, flags.OKAsDelegate)
+	}
+
+	if renewTill.IsZero() {
+		renewTill = end
+		if renewable > 0 {
+			renewTill = now.Add(renewable)
+		}
+	}
+
+	if renewTill.After(end) {
+		types.SetFlag(&ticketFlags, flags.Renewable)
+	} else {
+		end = renewTill
+	}
+
+	skvno := 0
+
+	for _, entry := range k.kt.Entries {
+		if entry.Principal.Components[0] == body.SName.NameString[0] && int(entry.KVNO) > skvno {
+			skvno = int(entry.KVNO)
+		}
+	}
+
+	ticket, sessionKey, err := messages.NewTicket(cname, testRealm, body.SName, body.Realm, ticketFlags, k.kt,
+		etypeID.AES256_CTS_HMAC_SHA1_96, skvno, now, now, end, renewTill)
+	if err != nil {
+		return ticket, types.EncryptedData{}, err
+	}
+
+	part := messages.EncKDCRepPart{
+		Key:       sessionKey,
+		LastReqs:  []messages.LastReq{},
+		Nonce:     body.Nonce,
+		Flags:     ticketFlags,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   end,
+		RenewTill: renewTill,
+		SRealm:    body.Realm,
+		SName:     body.SName,
+	}
+
+	b, err := part.Marshal()
+	if err != nil {
+		return ticket, types.EncryptedData{}, err
+	}
+
+	encPart, err := crypto.GetEncryptedData(b, key, usage, kvno)
+
+	return ticket, encPart, err
+}
@@ -0,0 +1,240 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// keytabReloadInterval limits how often a keytab is forcibly reloaded so a
+// client can't cause it to be read for every handshake.
+const keytabReloadInterval = time.Second
+
+// loadedKeytab is a keytab along with the file details at the time it was
+// loaded.
+type loadedKeytab struct {
+	keytab   *keytab.Keytab
+	path     string
+	modTime  time.Time
+	size     int64
+	loadTime time.Time
+}
+
+// fresh reports whether the keytab is still current. If the file can't be
+// examined then the keytab is kept.
+func (k *loadedKeytab) fresh(force bool) bool {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return true
+	}
+
+	if !fi.ModTime().Equal(k.modTime) || fi.Size() != k.size {
+		return false
+	}
+
+	return !force || time.Since(k.loadTime) < keytabReloadInterval
+}
+
+// keytabCache holds the most recently loaded keytab, reloading it whenever
+// the file changes. Handshakes in progress keep using the keytab they
+// started with as a reload swaps in a new one atomically.
+type keytabCache struct {
+	path string
+
+	// mu serialises loading the keytab
+	mu      sync.Mutex
+	current atomic.Pointer[loadedKeytab]
+
+	logger logr.Logger
+}
+
+func newKeytabCache(path string, logger logr.Logger) *keytabCache {
+	return &keytabCache{
+		path:   path,
+		logger: logger,
+	}
+}
+
+// get returns the keytab, reloading it if the file has changed since it was
+// last loaded.
+func (c *keytabCache) get() (*keytab.Keytab, error) {
+	return c.load(false)
+}
+
+// reload returns the keytab, reloading it even if the file appears to be
+// unchanged unless it was only recently loaded.
+func (c *keytabCache) reload() (*keytab.Keytab, error) {
+	return c.load(true)
+}
+
+func (c *keytabCache) load(force bool) (*keytab.Keytab, error) {
+	if current := c.current.Load(); current != nil && current.fresh(force) {
+		return current.keytab, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another caller may have reloaded the keytab while waiting
+	current := c.current.Load()
+	if current != nil && current.fresh(force) {
+		return current.keytab, nil
+	}
+
+	next, err := c.read(current)
+	if err != nil {
+		if current == nil {
+			return nil, err
+		}
+
+		// Keep using the existing keys, the file might be partially
+		// written so try again next time
+		c.logger.Error(err, "unable to reload keytab", "path", current.path)
+
+		return current.keytab, nil
+	}
+
+	c.current.Store(next)
+
+	if current != nil {
+		c.logger.Info("reloaded keytab", "path", next.path)
+	}
+
+	return next.keytab, nil
+}
+
+func (c *keytabCache) read(current *loadedKeytab) (*loadedKeytab, error) {
+	var (
+		path string
+		err  error
+	)
+
+	if current != nil {
+		path = current.path
+	} else if path, err = findKeytab(c.logger, c.path); err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	kt, err := keytab.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &loadedKeytab{
+		keytab:   kt,
+		path:     path,
+		modTime:  fi.ModTime(),
+		size:     fi.Size(),
+		loadTime: time.Now(),
+	}, nil
+}
+
+// validateKeytab checks the keytab can be loaded and has at least one usable
+// key for every service principal or, if there are none, for any service.
+func (s *Server) validateKeytab() error {
+	kt, path := s.keytabData, ""
+
+	if s.keytabs != nil {
+		var err error
+
+		if kt, err = s.keytabs.get(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				err = fmt.Errorf("%w: %w", ErrNoKeytab, err)
+			}
+
+			return &KeytabError{Path: strings.TrimPrefix(s.keytab, krb5FilePrefix), Err: err}
+		}
+
+		path = s.keytabs.current.Load().path
+	}
+
+	if len(s.principals) == 0 {
+		if err := s.checkWeakKeys(keytabKeys(kt, func(components []string) bool {
+			return len(components) == 0 || components[0] != "krbtgt"
+		}), path, ""); err != nil {
+			return &KeytabError{Path: path, Err: err}
+		}
+
+		return nil
+	}
+
+	for _, principal := range s.principals {
+		if err := s.checkWeakKeys(keytabKeys(kt, func(components []string) bool {
+			return slices.Equal(components, strings.Split(principal, "/"))
+		}), path, principal); err != nil {
+			return &KeytabError{Path: path, Principal: principal, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// checkWeakKeys logs a warning rather than returning ErrWeakKey if weak keys
+// are allowed.
+func (s *Server) checkWeakKeys(err error, path, principal string) error {
+	if !errors.Is(err, ErrWeakKey) || !s.weakKeys {
+		return err
+	}
+
+	s.logger.Info("keytab only has weak keys", "path", path, "principal", principal)
+
+	return nil
+}
+
+// keytabKeys checks the keytab has at least one usable key for a principal
+// matched by match. Keys using encryption types that aren't supported are
+// ignored.
+func keytabKeys(kt *keytab.Keytab, match func([]string) bool) error {
+	var weak bool
+
+	for _, entry := range kt.Entries {
+		if !match(entry.Principal.Components) {
+			continue
+		}
+
+		if _, err := crypto.GetEtype(entry.Key.KeyType); err != nil {
+			continue
+		}
+
+		if !weakEtype(entry.Key.KeyType) {
+			return nil
+		}
+
+		weak = true
+	}
+
+	if weak {
+		return ErrWeakKey
+	}
+
+	return ErrNoKey
+}
+
+// weakEtype reports whether the encryption type is deprecated by RFC 8429.
+func weakEtype(etype int32) bool {
+	switch etype {
+	case etypeID.RC4_HMAC, etypeID.RC4_HMAC_EXP, etypeID.DES3_CBC_SHA1_KD:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,145 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// renewRetryInterval is how long to wait before trying again if the TGT
+// couldn't be renewed or a new one couldn't be obtained.
+const renewRetryInterval = time.Minute
+
+// renew keeps the TGT valid until the Client is closed, renewing it while
+// it is renewable and logging in again once it isn't.
+func (c *Client) renew() {
+	defer close(c.done)
+
+	for {
+		timer := time.NewTimer(c.nextRefresh())
+
+		select {
+		case <-c.stop:
+			timer.Stop()
+
+			return
+		case <-timer.C:
+		}
+
+		err := c.refresh()
+		if errors.Is(err, errNoTGT) {
+			c.logger.Info("TGT can't be renewed and there are no credentials to log in again")
+
+			return
+		}
+
+		if err != nil {
+			c.logger.Error(err, "unable to refresh TGT", "retry", renewRetryInterval)
+
+			timer = time.NewTimer(renewRetryInterval)
+
+			select {
+			case <-c.stop:
+				timer.Stop()
+
+				return
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// nextRefresh returns how long until the TGT should be refreshed, which is
+// once five sixths of its lifetime has passed.
+func (c *Client) nextRefresh() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tgt, ok := c.storedTGT()
+	if !ok {
+		return 0
+	}
+
+	start := tgt.StartTime
+	if start.IsZero() {
+		start = tgt.AuthTime
+	}
+
+	return start.Add(tgt.EndTime.Sub(start) * 5 / 6).Sub(c.now())
+}
+
+// refresh renews the TGT if it is renewable, otherwise it logs in again if
+// possible. The exchanges with the KDC are done without the lock held so
+// other connections aren't held up if it can't be reached.
+func (c *Client) refresh() error {
+	c.mu.Lock()
+	tgt, ok := c.storedTGT()
+	realm := c.stored.GetClientRealm()
+	c.mu.Unlock()
+
+	err := errNoTGT
+
+	if ok && types.IsFlagSet(&tgt.TicketFlags, flags.Renewable) && tgt.RenewTill.After(tgt.EndTime) {
+		if err = c.renewTGT(tgt, realm); err != nil {
+			c.logger.Error(err, "unable to renew TGT")
+		}
+	}
+
+	if err != nil && c.canLogin() {
+		err = c.login(tgt)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The TGT can still be used even if it can't be stored
+	if err = c.writeStoredCCache(); err != nil {
+		c.logger.Error(err, "unable to store TGT")
+	}
+
+	return nil
+}
+
+// renewTGT renews the TGT, replacing it in the stored credentials cache
+// unless it has been replaced in the meantime. It must be called without the
+// lock held.
+func (c *Client) renewTGT(tgt *credentials.Credential, realm string) error {
+	var ticket messages.Ticket
+	if err := ticket.Unmarshal(tgt.Ticket); err != nil {
+		return err
+	}
+
+	_, tgsRep, err := c.client.TGSREQGenerateAndExchange(tgt.Server.PrincipalName, realm, ticket, tgt.Key, true)
+	if err != nil {
+		return err
+	}
+
+	cred, err := newCredential(tgsRep.CRealm, tgsRep.CName, tgsRep.Ticket, tgsRep.DecryptedEncPart)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, existing := range c.stored.Credentials {
+		if existing == tgt {
+			c.stored.Credentials[i] = cred
+		}
+	}
+
+	c.logger.Info("renewed TGT", "principal", tgsRep.CName.PrincipalNameString()+"@"+realm, "until", cred.EndTime)
+
+	return nil
+}
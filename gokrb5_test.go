@@ -4,12 +4,411 @@
 package sshkrb5_test
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bodgit/sshkrb5"
+	"github.com/go-logr/logr/testr"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/adtype"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/pac"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/test/testdata"
+	"github.com/jcmturner/gokrb5/v8/types"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
 )
 
+const (
+	testRealm    = "EXAMPLE.COM"
+	testService  = "host/ssh.example.com"
+	testAlias    = "host/alias.example.com"
+	testHTTP     = "HTTP/lb.example.com"
+	testPassword = "password"
+)
+
+func newTestKeytab(t *testing.T) (*keytab.Keytab, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "krb5.keytab")
+
+	return writeTestKeytab(t, path, 1, testPassword), path
+}
+
+func writeTestKeytab(t *testing.T, path string, kvno uint8, password string) *keytab.Keytab {
+	t.Helper()
+
+	kt := keytab.New()
+
+	for _, principal := range []string{testService, testAlias, testHTTP, "krbtgt/" + testRealm} {
+		if err := kt.AddEntry(principal, testRealm, password, time.Now(), kvno, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return kt
+}
+
+func newTestTicket(kt *keytab.Keytab, username, service string) (messages.Ticket, types.EncryptionKey, error) {
+	return newTestTicketWithLifetime(kt, username, service, time.Hour)
+}
+
+func newTestTicketWithLifetime(kt *keytab.Keytab, username, service string,
+	lifetime time.Duration) (messages.Ticket, types.EncryptionKey, error) {
+	var (
+		cname = types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, username)
+		sname = types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service)
+		now   = time.Now().UTC()
+	)
+
+	kvno := 0
+
+	for _, entry := range kt.Entries {
+		if entry.Principal.Components[0] == sname.NameString[0] && int(entry.KVNO) > kvno {
+			kvno = int(entry.KVNO)
+		}
+	}
+
+	return messages.NewTicket(cname, testRealm, sname, testRealm, types.NewKrbFlags(), kt,
+		etypeID.AES256_CTS_HMAC_SHA1_96, kvno, now, now, now.Add(lifetime), now.Add(lifetime))
+}
+
+// newTestPAC returns the gokrb5 PAC test vector with the server signature
+// replaced using the service key, or left invalid if sign is false. If
+// logonInfo is false the PAC has no logon information, like those issued by
+// MIT krb5.
+func newTestPAC(kt *keytab.Keytab, service string, sign, logonInfo bool) ([]byte, error) {
+	b, err := hex.DecodeString(testdata.MarshaledPAC_AD_WIN2K_PAC)
+	if err != nil {
+		return nil, err
+	}
+
+	var p pac.PACType
+	if err := p.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	var signature []byte
+
+	// Zero both signatures, the KDC signature can't be checked anyway
+	for i, buf := range p.Buffers {
+		// Change the buffer type so it's skipped as an unknown type
+		if buf.ULType == 1 && !logonInfo {
+			binary.LittleEndian.PutUint32(b[8+i*16:], 0xff)
+		}
+
+		if buf.ULType == 6 || buf.ULType == 7 {
+			clear(b[buf.Offset+4 : buf.Offset+uint64(buf.CBBufferSize)])
+		}
+
+		if buf.ULType == 6 {
+			signature = b[buf.Offset+4 : buf.Offset+uint64(buf.CBBufferSize)]
+		}
+	}
+
+	if !sign {
+		return b, nil
+	}
+
+	key, _, err := kt.GetEncryptionKey(types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service), testRealm, 0,
+		etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum, err := e.GetChecksumHash(key.KeyValue, b, keyusage.KERB_NON_KERB_CKSUM_SALT)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(signature, checksum)
+
+	return b, nil
+}
+
+// newTestPACTicket is the same as newTestTicket except the ticket carries
+// the PAC.
+func newTestPACTicket(kt *keytab.Keytab, username, service string, b []byte) (messages.Ticket, types.EncryptionKey,
+	error) {
+	var (
+		cname = types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, username)
+		sname = types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service)
+		now   = time.Now().UTC()
+	)
+
+	e, err := crypto.GetEtype(etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+
+	key, err := types.GenerateEncryptionKey(e)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+
+	ad, err := asn1.Marshal(types.AuthorizationData{
+		{
+			ADType: adtype.ADWin2KPAC,
+			ADData: b,
+		},
+	})
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+
+	b, err = asn1.Marshal(messages.EncTicketPart{
+		Flags:     types.NewKrbFlags(),
+		Key:       key,
+		CRealm:    testRealm,
+		CName:     cname,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   now.Add(time.Hour),
+		AuthorizationData: types.AuthorizationData{
+			{
+				ADType: adtype.ADIfRelevant,
+				ADData: ad,
+			},
+		},
+	})
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+
+	skey, kvno, err := kt.GetEncryptionKey(sname, testRealm, 0, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+
+	encPart, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(b, asnAppTag.EncTicketPart), skey,
+		keyusage.KDC_REP_TICKET, kvno)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+
+	return messages.Ticket{
+		TktVNO:  iana.PVNO,
+		Realm:   testRealm,
+		SName:   sname,
+		EncPart: encPart,
+	}, key, nil
+}
+
+type testKRBCred struct {
+	PVNO    int                 `asn1:"explicit,tag:0"`
+	MsgType int                 `asn1:"explicit,tag:1"`
+	Tickets asn1.RawValue       `asn1:"explicit,tag:2"`
+	EncPart types.EncryptedData `asn1:"explicit,tag:3"`
+}
+
+// newTestKRBCred returns a KRB-CRED containing a TGT for the user encrypted
+// with the session key, as used for delegation.
+func newTestKRBCred(kt *keytab.Keytab, username string, key types.EncryptionKey) ([]byte, error) {
+	tgt, tgtKey, err := newTestTicket(kt, username, "krbtgt/"+testRealm)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	b, err := asn1.Marshal(messages.EncKrbCredPart{
+		TicketInfo: []messages.KrbCredInfo{
+			{
+				Key:       tgtKey,
+				PRealm:    testRealm,
+				PName:     types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, username),
+				Flags:     types.NewKrbFlags(),
+				AuthTime:  now,
+				StartTime: now,
+				EndTime:   now.Add(time.Hour),
+				SRealm:    testRealm,
+				SName:     tgt.SName,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encPart, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(b, asnAppTag.EncKrbCredPart),
+		key, keyusage.KRB_CRED_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tickets, err := messages.MarshalTicketSequence([]messages.Ticket{tgt})
+	if err != nil {
+		return nil, err
+	}
+
+	tickets.Tag = 2
+
+	b, err = asn1.Marshal(testKRBCred{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_CRED,
+		Tickets: tickets,
+		EncPart: encPart,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1tools.AddASNAppTag(b, asnAppTag.KRBCred), nil
+}
+
+// testInitiator is the minimum needed to fake the client side of a
+// GSSAPI exchange without a KDC.
+type testInitiator struct {
+	key            types.EncryptionKey
+	sequenceNumber uint64
+}
+
+func newTestInitiator(kt *keytab.Keytab, service, username string, delegate bool) (*testInitiator, []byte, error) {
+	tkt, key, err := newTestTicket(kt, username, service)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newTestAPReq(kt, tkt, key, username, delegate)
+}
+
+func newTestAPReq(kt *keytab.Keytab, tkt messages.Ticket, key types.EncryptionKey, username string,
+	delegate bool) (*testInitiator, []byte, error) {
+	auth, err := types.NewAuthenticator(testRealm, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, username))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum[:4], 16)
+	binary.LittleEndian.PutUint32(checksum[20:24], gssapi.ContextFlagMutual|gssapi.ContextFlagInteg)
+
+	if delegate {
+		cred, err := newTestKRBCred(kt, username, key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		binary.LittleEndian.PutUint32(checksum[20:24],
+			binary.LittleEndian.Uint32(checksum[20:24])|gssapi.ContextFlagDeleg)
+		checksum = binary.LittleEndian.AppendUint16(checksum, 1)
+		checksum = binary.LittleEndian.AppendUint16(checksum, uint16(len(cred))) //nolint:gosec
+		checksum = append(checksum, cred...)
+	}
+
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  checksum,
+	}
+
+	apreq, err := messages.NewAPReq(tkt, key, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	types.SetFlag(&apreq.APOptions, flags.APOptionMutualRequired)
+
+	b, err := apreq.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	token = append(token, 0x01, 0x00)
+	token = append(token, b...)
+
+	return &testInitiator{
+		key:            key,
+		sequenceNumber: uint64(auth.SeqNumber), //nolint:gosec
+	}, asn1tools.AddASNAppTag(token, 0), nil
+}
+
+func (i *testInitiator) getMIC(message []byte) ([]byte, error) {
+	token := gssapi.MICToken{
+		SndSeqNum: i.sequenceNumber,
+		Payload:   message,
+	}
+
+	if err := token.SetChecksum(i.key, keyusage.GSSAPI_INITIATOR_SIGN); err != nil {
+		return nil, err
+	}
+
+	i.sequenceNumber++
+
+	return token.Marshal()
+}
+
+func testServerContext(ctx *sshkrb5.ServerContext, kt *keytab.Keytab, service, username string, delegate bool) error {
+	initiator, token, err := newTestInitiator(kt, service, username, delegate)
+	if err != nil {
+		return err
+	}
+
+	_, name, cont, err := ctx.AcceptSecContext(token)
+	if err != nil {
+		return err
+	}
+
+	if cont {
+		return fmt.Errorf("%s: unexpected continuation", username) //nolint:err113
+	}
+
+	if name != username+"@"+testRealm {
+		return fmt.Errorf("%s: unexpected peer name %s", username, name) //nolint:err113
+	}
+
+	mic, err := initiator.getMIC([]byte(username))
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.VerifyMIC([]byte(username), mic); err != nil {
+		return err
+	}
+
+	return ctx.DeleteSecContext()
+}
+
 func TestNewClient(t *testing.T) {
 	t.Parallel()
 
@@ -50,10 +449,2460 @@ func TestNewClientWithConfig(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestNewServer(t *testing.T) {
+func newTestCCache(t *testing.T, kt *keytab.Keytab, path, username string) []byte {
+	t.Helper()
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	ctx := server.NewContext()
+
+	if err := testServerContext(ctx, kt, testService, username, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ccache, err := ctx.WriteDelegatedCredentials(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ccache.Destroy()
+
+	b, err := os.ReadFile(ccache.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestNewClientWithCCache(t *testing.T) {
 	t.Parallel()
 
-	if err := testNewServer(t); err != nil {
+	kt, path := newTestKeytab(t)
+
+	alice := newTestCCache(t, kt, path, "alice")
+	bob := newTestCCache(t, kt, path, "bob")
+
+	dir := t.TempDir()
+
+	for name, b := range map[string][]byte{
+		"tktalice": alice,
+		"tktbob":   bob,
+		"primary":  []byte("tktbob\n"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aliceFile := filepath.Join(dir, "tktalice")
+
+	tables := []struct {
+		name      string
+		options   []sshkrb5.Option[sshkrb5.Client]
+		principal string
+		err       bool
+	}{
+		{
+			"path",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache(aliceFile),
+			},
+			"alice@" + testRealm,
+			false,
+		},
+		{
+			"file",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache("FILE:" + aliceFile),
+				sshkrb5.WithCCachePrincipal("alice@" + testRealm),
+			},
+			"alice@" + testRealm,
+			false,
+		},
+		{
+			"file wrong principal",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache("FILE:" + aliceFile),
+				sshkrb5.WithCCachePrincipal("bob"),
+			},
+			"",
+			true,
+		},
+		{
+			"bytes",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCacheBytes(bob),
+				sshkrb5.WithCCachePrincipal("bob"),
+			},
+			"bob@" + testRealm,
+			false,
+		},
+		{
+			"collection primary",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache("DIR:" + dir),
+			},
+			"bob@" + testRealm,
+			false,
+		},
+		{
+			"collection principal",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache("DIR:" + dir),
+				sshkrb5.WithCCachePrincipal("alice"),
+			},
+			"alice@" + testRealm,
+			false,
+		},
+		{
+			"collection unknown principal",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache("DIR:" + dir),
+				sshkrb5.WithCCachePrincipal("alice@OTHER.EXAMPLE.COM"),
+			},
+			"",
+			true,
+		},
+		{
+			"collection member",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache("DIR::" + aliceFile),
+			},
+			"alice@" + testRealm,
+			false,
+		},
+		{
+			"unsupported",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithCCache("KEYRING:persistent:1000"),
+			},
+			"",
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			options := append([]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithConfig("[libdefaults]\n default_realm = " + testRealm + "\n"),
+			}, table.options...)
+
+			client, err := sshkrb5.NewClient(options...)
+			if table.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			defer client.Close()
+
+			assert.Equal(t, table.principal, sshkrb5.ClientPrincipal(client))
+		})
+	}
+
+	_, err := sshkrb5.NewClient(sshkrb5.WithCCacheBytes([]byte("invalid")))
+	assert.Error(t, err)
+}
+
+func TestNewClientStoreCCache(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithServicePrincipal(testService))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	ccache := filepath.Join(t.TempDir(), "krb5cc")
+
+	options := []sshkrb5.Option[sshkrb5.Client]{
+		sshkrb5.WithConfig(kdc.config()),
+		sshkrb5.WithDomain(testRealm),
+		sshkrb5.WithUsername("test"),
+		sshkrb5.WithPassword(testPassword),
+		sshkrb5.WithStoreCCache(ccache),
+	}
+
+	tables := []struct {
+		name    string
+		options []sshkrb5.Option[sshkrb5.Client]
+		as, tgs int
+	}{
+		{
+			"login",
+			options,
+			1,
+			1,
+		},
+		{
+			"stored",
+			options,
+			1,
+			1,
+		},
+		{
+			"ccache",
+			[]sshkrb5.Option[sshkrb5.Client]{
+				sshkrb5.WithConfig(kdc.config()),
+				sshkrb5.WithCCache(ccache),
+			},
+			1,
+			1,
+		},
+	}
+
+	for _, table := range tables {
+		client, err := sshkrb5.NewClient(table.options...)
+		if err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		token, _, err := client.InitSecContext("host@ssh.example.com", nil, false)
+		if err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		_, name, _, err := server.AcceptSecContext(token)
+		if assert.NoError(t, err, table.name) {
+			assert.Equal(t, "test@"+testRealm, name, table.name)
+		}
+
+		assert.NoError(t, server.DeleteSecContext(), table.name)
+		assert.NoError(t, client.Close(), table.name)
+
+		as, tgs := kdc.counts()
+		assert.Equal(t, table.as, as, table.name)
+		assert.Equal(t, table.tgs, tgs, table.name)
+	}
+
+	fi, err := os.Stat(ccache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	loaded, err := credentials.LoadCCache(ccache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "test", loaded.GetClientPrincipalName().PrincipalNameString())
+	assert.True(t, loaded.Contains(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+testRealm)))
+	assert.True(t, loaded.Contains(types.NewPrincipalName(nametype.KRB_NT_SRV_HST, testService)))
+}
+
+func TestClientRenewal(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name      string
+		renewable time.Duration
+		renewed   bool
+	}{
+		{
+			"renew",
+			time.Minute,
+			true,
+		},
+		{
+			"login",
+			0,
+			false,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			kt, path := newTestKeytab(t)
+			kdc := newTestKDC(t, kt, "test")
+			kdc.lifetime = 2 * time.Second
+			kdc.renewable = table.renewable
+
+			server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path),
+				sshkrb5.WithServicePrincipal(testService))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Close()
+
+			client, err := sshkrb5.NewClient(
+				sshkrb5.WithConfig(kdc.config()),
+				sshkrb5.WithDomain(testRealm),
+				sshkrb5.WithUsername("test"),
+				sshkrb5.WithPassword(testPassword),
+				sshkrb5.WithLogger[sshkrb5.Client](testr.New(t)),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Outlive the first TGT
+			time.Sleep(2500 * time.Millisecond)
+
+			token, _, err := client.InitSecContext("host@ssh.example.com", nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = server.AcceptSecContext(token)
+			assert.NoError(t, err)
+
+			assert.NoError(t, client.Close())
+
+			// Renewing avoids logging in again
+			as, _ := kdc.counts()
+			if table.renewed {
+				assert.Equal(t, 1, as)
+				assert.Positive(t, kdc.renewals())
+			} else {
+				assert.Greater(t, as, 1)
+				assert.Zero(t, kdc.renewals())
+			}
+
+			// Nothing is refreshed once the Client is closed
+			renewals := kdc.renewals()
+
+			time.Sleep(2 * time.Second)
+
+			after, _ := kdc.counts()
+			assert.Equal(t, as, after)
+			assert.Equal(t, renewals, kdc.renewals())
+		})
+	}
+}
+
+func TestClientRenewalUnreachable(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+	kdc.lifetime = 3 * time.Second
+	kdc.renewable = time.Minute
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path),
+		sshkrb5.WithServicePrincipal(testService))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	client, err := sshkrb5.NewClient(
+		sshkrb5.WithConfig(kdc.config()),
+		sshkrb5.WithDomain(testRealm),
+		sshkrb5.WithUsername("test"),
+		sshkrb5.WithPassword(testPassword),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if _, _, err = client.NewContext().InitSecContext("host@ssh.example.com", nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	kdc.stall()
+
+	// Close waits for the renewal
+	defer kdc.resume()
+
+	assert.Eventually(t, func() bool {
+		return kdc.waiting() > 0
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// The cached service ticket is still usable while the renewal waits
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	token, _, err := client.NewContextWithContext(ctx).InitSecContext("host@ssh.example.com", nil, false)
+	if err != nil {
 		t.Fatal(err)
 	}
+
+	_, _, _, err = server.NewContext().AcceptSecContext(token)
+	assert.NoError(t, err)
+}
+
+func TestClientContextConcurrentLogin(t *testing.T) {
+	t.Parallel()
+
+	kt, _ := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+
+	var offset atomic.Int64
+
+	client, err := sshkrb5.NewClient(
+		sshkrb5.WithConfig(kdc.config()),
+		sshkrb5.WithDomain(testRealm),
+		sshkrb5.WithUsername("test"),
+		sshkrb5.WithPassword(testPassword),
+		sshkrb5.WithClock[sshkrb5.Client](func() time.Time {
+			return time.Now().Add(time.Duration(offset.Load()))
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	// Expire the TGT, the new one outlives the clock
+	offset.Store(int64(2 * time.Hour))
+	kdc.setLifetime(4 * time.Hour)
+
+	var wg sync.WaitGroup
+
+	for range 50 {
+		wg.Go(func() {
+			_, _, err := client.NewContext().InitSecContext("host@ssh.example.com", nil, false)
+			assert.NoError(t, err)
+		})
+	}
+
+	wg.Wait()
+
+	// Only the first login and one more
+	as, _ := kdc.counts()
+	assert.Equal(t, 2, as)
+}
+
+func TestClientContextConcurrent(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithServicePrincipal(testService))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	client, err := sshkrb5.NewClient(
+		sshkrb5.WithConfig(kdc.config()),
+		sshkrb5.WithDomain(testRealm),
+		sshkrb5.WithUsername("test"),
+		sshkrb5.WithPassword(testPassword),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for range 50 {
+		wg.Go(func() {
+			ctx, sctx := client.NewContext(), server.NewContext()
+
+			token, _, err := ctx.InitSecContext("host@ssh.example.com", nil, false)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			token, name, _, err := sctx.AcceptSecContext(token)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, "test@"+testRealm, name)
+
+			_, cont, err := ctx.InitSecContext("host@ssh.example.com", token, false)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.False(t, cont)
+
+			mic, err := ctx.GetMIC([]byte("test"))
+			if assert.NoError(t, err) {
+				assert.NoError(t, sctx.VerifyMIC([]byte("test"), mic))
+			}
+
+			assert.NoError(t, ctx.DeleteSecContext())
+			assert.NoError(t, sctx.DeleteSecContext())
+		})
+	}
+
+	wg.Wait()
+
+	assert.NoError(t, client.Close())
+
+	// The credentials are shared by every context
+	as, _ := kdc.counts()
+	assert.Equal(t, 1, as)
+}
+
+type testResolver struct {
+	cnames map[string]string
+	hosts  map[string][]string
+	addrs  map[string][]string
+}
+
+func (r *testResolver) LookupCNAME(_ context.Context, host string) (string, error) {
+	if cname, ok := r.cnames[host]; ok {
+		return cname, nil
+	}
+
+	return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *testResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *testResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if names, ok := r.addrs[addr]; ok {
+		return names, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestClientTrustDNS(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithServicePrincipal(testService))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	resolver := &testResolver{
+		cnames: map[string]string{
+			"ssh":             "ssh.example.com.",
+			"www.example.com": "SSH.example.com.",
+			"web":             "web.example.net.",
+			"ssh.example.com": "ssh.example.com.",
+		},
+		hosts: map[string][]string{
+			"web.example.net": {"192.0.2.1"},
+		},
+		addrs: map[string][]string{
+			"192.0.2.1": {"ssh.example.com."},
+		},
+	}
+
+	tables := []struct {
+		name     string
+		target   string
+		trustDNS bool
+		rdns     bool
+		err      bool
+	}{
+		{
+			"short name",
+			"ssh",
+			true,
+			false,
+			false,
+		},
+		{
+			"cname",
+			"www.example.com",
+			true,
+			false,
+			false,
+		},
+		{
+			"reverse",
+			"web",
+			true,
+			true,
+			false,
+		},
+		{
+			"address",
+			"192.0.2.1",
+			true,
+			true,
+			false,
+		},
+		{
+			"reverse fallback",
+			"ssh.example.com",
+			true,
+			true,
+			false,
+		},
+		{
+			"forward only",
+			"web",
+			true,
+			false,
+			true,
+		},
+		{
+			"disabled",
+			"ssh",
+			false,
+			true,
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		client, err := sshkrb5.NewClient(
+			sshkrb5.WithConfig(kdc.config()),
+			sshkrb5.WithDomain(testRealm),
+			sshkrb5.WithUsername("test"),
+			sshkrb5.WithPassword(testPassword),
+			sshkrb5.WithTrustDNS(table.trustDNS),
+			sshkrb5.WithReverseDNS(table.rdns),
+			sshkrb5.WithResolver(resolver),
+		)
+		if err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		ctx := server.NewContext()
+
+		token, _, err := client.InitSecContext("host@"+table.target, nil, false)
+		if table.err {
+			assert.Error(t, err, table.name)
+		} else if assert.NoError(t, err, table.name) {
+			_, _, _, err = ctx.AcceptSecContext(token)
+			assert.NoError(t, err, table.name)
+		}
+
+		assert.NoError(t, ctx.DeleteSecContext(), table.name)
+		assert.NoError(t, client.Close(), table.name)
+	}
+}
+
+func TestWithServerIdentity(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path),
+		sshkrb5.WithServicePrincipal(testService, testHTTP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	tables := []struct {
+		name     string
+		identity string
+		service  string
+		err      bool
+	}{
+		{
+			"hostname",
+			"ssh.example.com",
+			testService,
+			false,
+		},
+		{
+			"principal",
+			testHTTP,
+			testHTTP,
+			false,
+		},
+		{
+			"none",
+			"",
+			"",
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		options := []sshkrb5.Option[sshkrb5.Client]{
+			sshkrb5.WithConfig(kdc.config()),
+			sshkrb5.WithDomain(testRealm),
+			sshkrb5.WithUsername("test"),
+			sshkrb5.WithPassword(testPassword),
+		}
+
+		if table.identity != "" {
+			options = append(options, sshkrb5.WithServerIdentity(table.identity))
+		}
+
+		client, err := sshkrb5.NewClient(options...)
+		if err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		ctx := server.NewContext()
+
+		// The hostname dialled isn't a principal in the keytab
+		token, _, err := client.InitSecContext("host@vip.example.com", nil, false)
+		if table.err {
+			assert.Error(t, err, table.name)
+		} else if assert.NoError(t, err, table.name) {
+			_, _, _, err = ctx.AcceptSecContext(token)
+			assert.NoError(t, err, table.name)
+
+			service, err := ctx.ServicePrincipal()
+			if assert.NoError(t, err, table.name) {
+				assert.Equal(t, table.service+"@"+testRealm, service, table.name)
+			}
+		}
+
+		assert.NoError(t, ctx.DeleteSecContext(), table.name)
+		assert.NoError(t, client.Close(), table.name)
+	}
+
+	for _, identity := range []string{"", "host/", "/ssh.example.com", "host/ssh/example.com", "host@ssh/example.com"} {
+		_, err := sshkrb5.NewClient(sshkrb5.WithServerIdentity(identity))
+		assert.Error(t, err, identity)
+	}
+}
+
+func TestClientDelegation(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+	kdc.okAsDelegate = []string{testHTTP}
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path),
+		sshkrb5.WithServicePrincipal(testService, testHTTP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	forwardable := strings.Replace(kdc.config(), "[libdefaults]\n", "[libdefaults]\n forwardable = true\n", 1)
+
+	tables := []struct {
+		name      string
+		config    string
+		policy    sshkrb5.DelegationPolicy
+		requested bool
+		target    string
+		delegated bool
+	}{
+		{
+			"not requested",
+			forwardable,
+			sshkrb5.DelegateRequested,
+			false,
+			"host@ssh.example.com",
+			false,
+		},
+		{
+			"requested",
+			forwardable,
+			sshkrb5.DelegateRequested,
+			true,
+			"host@ssh.example.com",
+			true,
+		},
+		{
+			"never",
+			forwardable,
+			sshkrb5.DelegateNever,
+			true,
+			"host@ssh.example.com",
+			false,
+		},
+		{
+			"always",
+			forwardable,
+			sshkrb5.DelegateAlways,
+			false,
+			"host@ssh.example.com",
+			true,
+		},
+		{
+			"not forwardable",
+			kdc.config(),
+			sshkrb5.DelegateAlways,
+			false,
+			"host@ssh.example.com",
+			false,
+		},
+		{
+			"ok-as-delegate",
+			forwardable,
+			sshkrb5.DelegateOKAsDelegate,
+			false,
+			"HTTP@lb.example.com",
+			true,
+		},
+		{
+			"not ok-as-delegate",
+			forwardable,
+			sshkrb5.DelegateOKAsDelegate,
+			false,
+			"host@ssh.example.com",
+			false,
+		},
+	}
+
+	for _, table := range tables {
+		client, err := sshkrb5.NewClient(
+			sshkrb5.WithConfig(table.config),
+			sshkrb5.WithDomain(testRealm),
+			sshkrb5.WithUsername("test"),
+			sshkrb5.WithPassword(testPassword),
+			sshkrb5.WithDelegationPolicy(table.policy),
+			sshkrb5.WithLogger[sshkrb5.Client](testr.New(t)),
+		)
+		if err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		ctx := server.NewContext()
+
+		token, _, err := client.InitSecContext(table.target, nil, table.requested)
+		if err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		if token, _, _, err = ctx.AcceptSecContext(token); err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		if _, _, err = client.InitSecContext(table.target, token, table.requested); err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		mic, err := client.GetMIC([]byte("test"))
+		if err != nil {
+			t.Fatal(table.name, err)
+		}
+
+		if assert.NoError(t, ctx.VerifyMIC([]byte("test"), mic), table.name) {
+			ccache, err := ctx.DelegatedCredentials()
+			if assert.NoError(t, err, table.name) && assert.Equal(t, table.delegated, ccache != nil, table.name) &&
+				table.delegated {
+				assert.Equal(t, "test", ccache.GetClientPrincipalName().PrincipalNameString(), table.name)
+
+				tgt, ok := ccache.GetEntry(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+testRealm))
+				if assert.True(t, ok, table.name) {
+					assert.True(t, types.IsFlagSet(&tgt.TicketFlags, flags.Forwarded), table.name)
+				}
+			}
+		}
+
+		assert.NoError(t, ctx.DeleteSecContext(), table.name)
+		assert.NoError(t, client.Close(), table.name)
+	}
+}
+
+func TestClientDelegationReplacedCCache(t *testing.T) {
+	t.Parallel()
+
+	kt, _ := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+	kdc.okAsDelegate = []string{testHTTP}
+
+	client, err := sshkrb5.NewClient(
+		sshkrb5.WithConfig(strings.Replace(kdc.config(), "[libdefaults]\n", "[libdefaults]\n forwardable = true\n", 1)),
+		sshkrb5.WithDomain(testRealm),
+		sshkrb5.WithUsername("test"),
+		sshkrb5.WithPassword(testPassword),
+		sshkrb5.WithDelegationPolicy(sshkrb5.DelegateOKAsDelegate),
+		sshkrb5.WithLogger[sshkrb5.Client](testr.New(t)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	// The flags of the service ticket that was obtained are used rather
+	// than looking it up again in the stored credentials cache
+	b, err := sshkrb5.ForwardCredentialsAfterLogin(client, testHTTP)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, b)
+	}
+
+	b, err = sshkrb5.ForwardCredentialsAfterLogin(client, testService)
+	if assert.NoError(t, err) {
+		assert.Nil(t, b)
+	}
+}
+
+func TestNewClientContext(t *testing.T) {
+	t.Parallel()
+
+	kt, _ := newTestKeytab(t)
+	kdc := newTestKDC(t, kt, "test")
+
+	options := []sshkrb5.Option[sshkrb5.Client]{
+		sshkrb5.WithConfig(kdc.config()),
+		sshkrb5.WithDomain(testRealm),
+		sshkrb5.WithUsername("test"),
+		sshkrb5.WithPassword(testPassword),
+	}
+
+	cancelled, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err := sshkrb5.NewClientContext(cancelled, options...)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	client, err := sshkrb5.NewClientContext(t.Context(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	kdc.stall()
+
+	// Neither logging in nor requesting a service ticket waits for the KDC
+	// beyond the deadline
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err = sshkrb5.NewClientContext(ctx, options...)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	ctx, cancel = context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+
+	_, _, err = client.NewContextWithContext(ctx).InitSecContext("host@ssh.example.com", nil, false)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Close waits for the abandoned exchange
+	kdc.resume()
+}
+
+func TestNewServer(t *testing.T) {
+	t.Parallel()
+
+	if err := testNewServer(t); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerContextConcurrent(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := range 100 {
+		wg.Go(func() {
+			assert.NoError(t, testServerContext(server.NewContext(), kt, testService, fmt.Sprintf("user%d", i), false))
+		})
+	}
+
+	wg.Wait()
+
+	assert.NoError(t, server.Close())
+}
+
+func TestServerContextDelegatedCredentials(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	tables := []struct {
+		name     string
+		delegate bool
+	}{
+		{
+			"delegated",
+			true,
+		},
+		{
+			"not delegated",
+			false,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := server.NewContext()
+
+			if err := testServerContext(ctx, kt, testService, "test", table.delegate); err != nil {
+				t.Fatal(err)
+			}
+
+			ccache, err := ctx.DelegatedCredentials()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !table.delegate {
+				assert.Nil(t, ccache)
+
+				return
+			}
+
+			if assert.NotNil(t, ccache) {
+				assert.Equal(t, "test", ccache.GetClientPrincipalName().PrincipalNameString())
+				assert.Equal(t, testRealm, ccache.GetClientRealm())
+				assert.True(t, ccache.Contains(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+testRealm)))
+			}
+		})
+	}
+}
+
+func TestServerContextPeerInfo(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	tables := []struct {
+		name     string
+		username string
+		instance string
+		delegate bool
+	}{
+		{
+			"delegated",
+			"test",
+			"",
+			true,
+		},
+		{
+			"not delegated",
+			"test",
+			"",
+			false,
+		},
+		{
+			"instance",
+			"test/admin",
+			"admin",
+			false,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := server.NewContext()
+
+			_, err := ctx.PeerInfo()
+			assert.Error(t, err)
+
+			start := time.Now().Truncate(time.Second)
+
+			if err := testServerContext(ctx, kt, testService, table.username, table.delegate); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := ctx.PeerInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, table.username+"@"+testRealm, info.Principal)
+			assert.Equal(t, "test", info.Primary)
+			assert.Equal(t, table.instance, info.Instance)
+			assert.Equal(t, testRealm, info.Realm)
+			assert.False(t, info.AuthTime.Before(start))
+			assert.Equal(t, info.AuthTime, info.StartTime)
+			assert.Equal(t, info.AuthTime.Add(time.Hour), info.EndTime)
+			assert.Equal(t, etypeID.AES256_CTS_HMAC_SHA1_96, info.EncType)
+			assert.False(t, info.HasFlag(flags.Forwardable))
+			assert.Equal(t, table.delegate, info.Delegated)
+		})
+	}
+}
+
+func TestServerContextLogonInfo(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false),
+		sshkrb5.WithAllowedGroups("S-1-5-21-3167651404-3865080224-2280184895-1108"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	noGroupsServer, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path),
+		sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer noGroupsServer.Close()
+
+	tables := []struct {
+		name      string
+		server    *sshkrb5.Server
+		pac       bool
+		sign      bool
+		logonInfo bool
+		reason    string
+	}{
+		{
+			"pac",
+			server,
+			true,
+			true,
+			true,
+			"",
+		},
+		{
+			"no pac",
+			server,
+			false,
+			false,
+			false,
+			"login denied: test@EXAMPLE.COM has no group membership information",
+		},
+		{
+			"invalid pac",
+			server,
+			true,
+			false,
+			true,
+			"",
+		},
+		{
+			"invalid pac without groups",
+			noGroupsServer,
+			true,
+			false,
+			true,
+			"",
+		},
+		{
+			"no logon info",
+			server,
+			true,
+			true,
+			false,
+			"login denied: test@EXAMPLE.COM has no group membership information",
+		},
+		{
+			"no logon info without groups",
+			noGroupsServer,
+			true,
+			false,
+			false,
+			"",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				tkt messages.Ticket
+				key types.EncryptionKey
+				err error
+			)
+
+			if table.pac {
+				var b []byte
+
+				if b, err = newTestPAC(kt, testService, table.sign, table.logonInfo); err != nil {
+					t.Fatal(err)
+				}
+
+				tkt, key, err = newTestPACTicket(kt, "test", testService, b)
+			} else {
+				tkt, key, err = newTestTicket(kt, "test", testService)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			initiator, token, err := newTestAPReq(kt, tkt, key, "test", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := table.server.NewContext()
+
+			output, name, cont, err := ctx.AcceptSecContext(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// An invalid PAC is only rejected if the groups are needed
+			if table.pac && !table.sign && table.logonInfo && table.server == server {
+				var m spnego.KRB5Token
+				if assert.True(t, cont) && assert.NoError(t, m.Unmarshal(output)) && assert.True(t, m.IsKRBError()) {
+					assert.Equal(t, errorcode.KRB_AP_ERR_MODIFIED, m.KRBError.ErrorCode)
+				}
+
+				return
+			}
+
+			mic, err := initiator.getMIC([]byte("test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ctx.VerifyMIC([]byte("test"), mic); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := ctx.PeerInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ctx.AllowLogin(testConnMetadata{user: "test"}, name)
+			if table.reason != "" {
+				assert.EqualError(t, err, table.reason)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if !table.pac || !table.sign || !table.logonInfo {
+				assert.Nil(t, info.LogonInfo)
+
+				return
+			}
+
+			if assert.NotNil(t, info.LogonInfo) {
+				assert.Equal(t, sshkrb5.LogonInfo{
+					Username:        "testuser1",
+					FullName:        "Test1 User1",
+					Domain:          "TEST",
+					DomainSID:       "S-1-5-21-3167651404-3865080224-2280184895",
+					UserSID:         "S-1-5-21-3167651404-3865080224-2280184895-1105",
+					PrimaryGroupSID: "S-1-5-21-3167651404-3865080224-2280184895-513",
+					GroupSIDs: []string{
+						"S-1-5-21-3167651404-3865080224-2280184895-513",
+						"S-1-5-21-3167651404-3865080224-2280184895-1108",
+						"S-1-5-21-3167651404-3865080224-2280184895-1109",
+						"S-1-5-21-3167651404-3865080224-2280184895-1115",
+						"S-1-5-21-3167651404-3865080224-2280184895-1116",
+						"S-1-5-21-3167651404-3865080224-2280184895-1114",
+						"S-1-5-21-3167651404-3865080224-2280184895-1111",
+					},
+					LogonServer: "ADDC",
+					UPN:         "testuser1@test.gokrb5",
+					DNSDomain:   "TEST.GOKRB5",
+				}, *info.LogonInfo)
+			}
+		})
+	}
+}
+
+func TestPeerInfoHasFlag(t *testing.T) {
+	t.Parallel()
+
+	info := sshkrb5.PeerInfo{
+		Flags: 0x40400000,
+	}
+
+	assert.True(t, info.HasFlag(flags.Forwardable))
+	assert.True(t, info.HasFlag(flags.Initial))
+	assert.False(t, info.HasFlag(flags.Renewable))
+	assert.False(t, info.HasFlag(32))
+}
+
+func TestServerContextWriteDelegatedCredentials(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	ctx := server.NewContext()
+
+	if err := testServerContext(ctx, kt, testService, "test", true); err != nil {
+		t.Fatal(err)
+	}
+
+	ccache, err := ctx.WriteDelegatedCredentials(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !assert.NotNil(t, ccache) {
+		return
+	}
+
+	assert.Equal(t, "KRB5CCNAME=FILE:"+ccache.Path(), ccache.Environ())
+
+	fi, err := os.Stat(ccache.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	loaded, err := credentials.LoadCCache(ccache.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "test", loaded.GetClientPrincipalName().PrincipalNameString())
+	assert.Equal(t, testRealm, loaded.GetClientRealm())
+	assert.True(t, loaded.Contains(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+testRealm)))
+
+	assert.NoError(t, ccache.Destroy())
+	assert.NoFileExists(t, ccache.Path())
+	assert.NoError(t, ccache.Destroy())
+}
+
+func TestWithServicePrincipal(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	tables := []struct {
+		name       string
+		principals []string
+		service    string
+		err        bool
+	}{
+		{
+			"host",
+			[]string{testService},
+			testService,
+			false,
+		},
+		{
+			"other service",
+			[]string{testService, testHTTP},
+			testHTTP,
+			false,
+		},
+		{
+			"not accepted",
+			[]string{testService},
+			testHTTP,
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path),
+				sshkrb5.WithServicePrincipal(table.principals...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Close()
+
+			err = testServerContext(server.NewContext(), kt, table.service, "test", false)
+			if table.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	for _, principal := range []string{"host", "host/", "/ssh.example.com", "host/ssh.example.com@EXAMPLE.COM"} {
+		_, err := sshkrb5.NewServer(sshkrb5.WithServicePrincipal(principal))
+		assert.Error(t, err, principal)
+	}
+}
+
+func TestServerContextServicePrincipal(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	tables := []struct {
+		name    string
+		service string
+		err     bool
+	}{
+		{
+			"host",
+			testService,
+			false,
+		},
+		{
+			"alias",
+			testAlias,
+			false,
+		},
+		{
+			"not host",
+			testHTTP,
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := server.NewContext()
+
+			_, err := ctx.ServicePrincipal()
+			assert.Error(t, err)
+
+			if err := testServerContext(ctx, kt, table.service, "test", false); table.err {
+				assert.Error(t, err)
+
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			principal, err := ctx.ServicePrincipal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, table.service+"@"+testRealm, principal)
+		})
+	}
+}
+
+func TestNewClientWithKeytabBytes(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	hostname, port, realm, username, _, path := testEnvironmentVariables(t)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := sshkrb5.NewClient(sshkrb5.WithRealm(realm), sshkrb5.WithUsername(username),
+		sshkrb5.WithKeytabBytes[sshkrb5.Client](b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	whoami, err := testConnectionWhoami(client, hostname, port, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Regexp(t, `\btest$`, whoami)
+}
+
+func TestServerInMemoryKeytab(t *testing.T) {
+	t.Parallel()
+
+	kt, _ := newTestKeytab(t)
+
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name   string
+		option sshkrb5.Option[sshkrb5.Server]
+	}{
+		{
+			"bytes",
+			sshkrb5.WithKeytabBytes[sshkrb5.Server](b),
+		},
+		{
+			"parsed",
+			sshkrb5.WithParsedKeytab[sshkrb5.Server](kt),
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, err := sshkrb5.NewServer(table.option, sshkrb5.WithServicePrincipal(testService))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Close()
+
+			assert.NoError(t, testServerContext(server.NewContext(), kt, testService, "test", false))
+		})
+	}
+
+	_, err = sshkrb5.NewServer(sshkrb5.WithKeytabBytes[sshkrb5.Server]([]byte("invalid")))
+	assert.Error(t, err)
+}
+
+func TestServerKeytabRotation(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name    string
+		modTime bool
+	}{
+		{
+			"file changed",
+			true,
+		},
+		{
+			"unknown kvno",
+			false,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			kt, path := newTestKeytab(t)
+
+			server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Close()
+
+			if err := testServerContext(server.NewContext(), kt, testService, "test", false); err != nil {
+				t.Fatal(err)
+			}
+
+			// Start a handshake with the old keys to prove it's unaffected
+			inflight := server.NewContext()
+
+			initiator, token, err := newTestInitiator(kt, testService, "test", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, _, err := inflight.AcceptSecContext(token); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rotated := writeTestKeytab(t, path, 2, "rotated")
+
+			if table.modTime {
+				err = os.Chtimes(path, time.Time{}, fi.ModTime().Add(time.Minute))
+			} else {
+				// Hide the change so only the unknown kvno triggers a
+				// reload, which is limited to once a second
+				err = os.Chtimes(path, time.Time{}, fi.ModTime())
+
+				time.Sleep(time.Second)
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.NoError(t, testServerContext(server.NewContext(), rotated, testService, "test", false))
+
+			mic, err := initiator.getMIC([]byte("test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.NoError(t, inflight.VerifyMIC([]byte("test"), mic))
+		})
+	}
+}
+
+func TestServerKeytabValidation(t *testing.T) {
+	t.Parallel()
+
+	_, path := newTestKeytab(t)
+
+	weak := keytab.New()
+	if err := weak.AddEntry(testService, testRealm, testPassword, time.Now(), 1, etypeID.RC4_HMAC); err != nil {
+		t.Fatal(err)
+	}
+
+	krbtgt := keytab.New()
+	if err := krbtgt.AddEntry("krbtgt/"+testRealm, testRealm, testPassword, time.Now(), 1,
+		etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.keytab")
+
+	tables := []struct {
+		name      string
+		options   []sshkrb5.Option[sshkrb5.Server]
+		err       error
+		path      string
+		principal string
+	}{
+		{
+			"valid",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithKeytab[sshkrb5.Server](path),
+				sshkrb5.WithServicePrincipal(testService, testHTTP),
+			},
+			nil,
+			"",
+			"",
+		},
+		{
+			"any service",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithKeytab[sshkrb5.Server](path),
+				sshkrb5.WithStrictMode(false),
+			},
+			nil,
+			"",
+			"",
+		},
+		{
+			"missing file",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithKeytab[sshkrb5.Server](missing),
+				sshkrb5.WithServicePrincipal(testService),
+			},
+			sshkrb5.ErrNoKeytab,
+			missing,
+			"",
+		},
+		{
+			"no key",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithKeytab[sshkrb5.Server](path),
+				sshkrb5.WithServicePrincipal(testService, "host/other.example.com"),
+			},
+			sshkrb5.ErrNoKey,
+			path,
+			"host/other.example.com",
+		},
+		{
+			"no service",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithParsedKeytab[sshkrb5.Server](krbtgt),
+				sshkrb5.WithStrictMode(false),
+			},
+			sshkrb5.ErrNoKey,
+			"",
+			"",
+		},
+		{
+			"weak key",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithParsedKeytab[sshkrb5.Server](weak),
+				sshkrb5.WithServicePrincipal(testService),
+			},
+			sshkrb5.ErrWeakKey,
+			"",
+			testService,
+		},
+		{
+			"weak key allowed",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithParsedKeytab[sshkrb5.Server](weak),
+				sshkrb5.WithServicePrincipal(testService),
+				sshkrb5.WithWeakKeys(true),
+			},
+			nil,
+			"",
+			"",
+		},
+		{
+			"disabled",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithKeytab[sshkrb5.Server](missing),
+				sshkrb5.WithServicePrincipal(testService),
+				sshkrb5.WithKeytabValidation(false),
+			},
+			nil,
+			"",
+			"",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, err := sshkrb5.NewServer(table.options...)
+			if table.err == nil {
+				if assert.NoError(t, err) {
+					assert.NoError(t, server.Close())
+				}
+
+				return
+			}
+
+			assert.ErrorIs(t, err, table.err)
+
+			var keytabErr *sshkrb5.KeytabError
+			if assert.ErrorAs(t, err, &keytabErr) {
+				assert.Equal(t, table.path, keytabErr.Path)
+				assert.Equal(t, table.principal, keytabErr.Principal)
+			}
+		})
+	}
+}
+
+func TestServerReplayCache(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	tables := []struct {
+		name   string
+		caches func(*testing.T) (sshkrb5.ReplayCache, sshkrb5.ReplayCache)
+		replay bool
+	}{
+		{
+			"memory",
+			func(_ *testing.T) (sshkrb5.ReplayCache, sshkrb5.ReplayCache) {
+				cache := sshkrb5.NewMemoryReplayCache()
+
+				return cache, cache
+			},
+			true,
+		},
+		{
+			"file",
+			func(t *testing.T) (sshkrb5.ReplayCache, sshkrb5.ReplayCache) {
+				t.Helper()
+
+				cache := sshkrb5.NewFileReplayCache(filepath.Join(t.TempDir(), "krb5.rcache"))
+
+				return cache, cache
+			},
+			true,
+		},
+		{
+			"file shared between servers",
+			func(t *testing.T) (sshkrb5.ReplayCache, sshkrb5.ReplayCache) {
+				t.Helper()
+
+				path := filepath.Join(t.TempDir(), "krb5.rcache")
+
+				return sshkrb5.NewFileReplayCache(path), sshkrb5.NewFileReplayCache(path)
+			},
+			true,
+		},
+		{
+			"disabled",
+			func(_ *testing.T) (sshkrb5.ReplayCache, sshkrb5.ReplayCache) {
+				return nil, nil
+			},
+			false,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			first, second := table.caches(t)
+
+			servers := make([]*sshkrb5.Server, 0, 2)
+
+			for _, cache := range []sshkrb5.ReplayCache{first, second} {
+				server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path),
+					sshkrb5.WithStrictMode(false), sshkrb5.WithReplayCache(cache))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer server.Close()
+
+				servers = append(servers, server)
+			}
+
+			// Record a token and then replay it
+			_, token, err := newTestInitiator(kt, testService, "test", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, _, err := servers[0].NewContext().AcceptSecContext(token); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = servers[1].NewContext().AcceptSecContext(token)
+			if table.replay {
+				assert.ErrorIs(t, err, sshkrb5.ErrReplay)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			// A fresh token is still accepted
+			_, token, err = newTestInitiator(kt, testService, "test", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = servers[1].NewContext().AcceptSecContext(token)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMemoryReplayCache(t *testing.T) {
+	t.Parallel()
+
+	cache := sshkrb5.NewMemoryReplayCache()
+
+	// Expiry is relative to the clock passed in, not the system clock
+	now := time.Now().Add(-time.Hour)
+
+	assert.NoError(t, cache.Add("expired", now, now.Add(-time.Second)))
+	assert.NoError(t, cache.Add("expired", now, now.Add(time.Minute)))
+	assert.ErrorIs(t, cache.Add("expired", now, now.Add(time.Minute)), sshkrb5.ErrReplay)
+	assert.NoError(t, cache.Add("expired", now.Add(time.Minute), now.Add(2*time.Minute)))
+}
+
+func TestMemoryReplayCacheSweep(t *testing.T) {
+	t.Parallel()
+
+	cache := sshkrb5.NewMemoryReplayCache()
+	now := time.Now()
+
+	assert.NoError(t, cache.Add("a", now, now.Add(time.Second)))
+
+	// Expired entries linger until the next sweep
+	assert.NoError(t, cache.Add("b", now.Add(2*time.Second), now.Add(time.Minute)))
+	assert.Equal(t, 2, cache.Len())
+
+	assert.NoError(t, cache.Add("c", now.Add(2*time.Minute), now.Add(3*time.Minute)))
+	assert.Equal(t, 1, cache.Len())
+}
+
+func BenchmarkMemoryReplayCacheAdd(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			cache := sshkrb5.NewMemoryReplayCache()
+			now := time.Now()
+
+			for i := range size {
+				if err := cache.Add("fill-"+strconv.Itoa(i), now, now.Add(time.Hour)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			for i := 0; b.Loop(); i++ {
+				if err := cache.Add(strconv.Itoa(i), now, now.Add(time.Hour)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestServerClock(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	tables := []struct {
+		name    string
+		offset  time.Duration
+		skew    time.Duration
+		errCode int32
+	}{
+		{
+			"valid",
+			0,
+			0,
+			0,
+		},
+		{
+			"ticket not yet valid",
+			-2 * time.Hour,
+			0,
+			errorcode.KRB_AP_ERR_TKT_NYV,
+		},
+		{
+			"ticket expired",
+			2 * time.Hour,
+			0,
+			errorcode.KRB_AP_ERR_TKT_EXPIRED,
+		},
+		{
+			"clock skew",
+			30 * time.Second,
+			0,
+			errorcode.KRB_AP_ERR_SKEW,
+		},
+		{
+			"clock skew allowed",
+			30 * time.Second,
+			time.Minute,
+			0,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			options := []sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithKeytab[sshkrb5.Server](path),
+				sshkrb5.WithStrictMode(false),
+				sshkrb5.WithClock[sshkrb5.Server](func() time.Time {
+					return time.Now().Add(table.offset)
+				}),
+			}
+
+			if table.skew > 0 {
+				options = append(options, sshkrb5.WithClockSkew[sshkrb5.Server](table.skew))
+			}
+
+			server, err := sshkrb5.NewServer(options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Close()
+
+			_, token, err := newTestInitiator(kt, testService, "test", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			output, _, cont, err := server.NewContext().AcceptSecContext(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if table.errCode == 0 {
+				assert.False(t, cont)
+
+				return
+			}
+
+			// The error is sent back to the client
+			assert.True(t, cont)
+
+			var krbError spnego.KRB5Token
+			if err := krbError.Unmarshal(output); err != nil {
+				t.Fatal(err)
+			}
+
+			if assert.True(t, krbError.IsKRBError()) {
+				assert.Equal(t, table.errCode, krbError.KRBError.ErrorCode)
+			}
+		})
+	}
+}
+
+func TestServerAuditHook(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	type testEvent struct {
+		stage  sshkrb5.AuditStage
+		reason sshkrb5.AuditReason
+	}
+
+	tables := []struct {
+		name    string
+		options []sshkrb5.Option[sshkrb5.Server]
+		service string
+		replay  bool
+		badMIC  bool
+		events  []testEvent
+	}{
+		{
+			"success",
+			nil,
+			testService,
+			false,
+			false,
+			[]testEvent{
+				{sshkrb5.AuditAcceptSecContext, sshkrb5.ReasonNone},
+				{sshkrb5.AuditVerifyMIC, sshkrb5.ReasonNone},
+				{sshkrb5.AuditAllowLogin, sshkrb5.ReasonNone},
+			},
+		},
+		{
+			"wrong service principal",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithServicePrincipal(testService),
+			},
+			testAlias,
+			false,
+			false,
+			[]testEvent{
+				{sshkrb5.AuditAcceptSecContext, sshkrb5.ReasonWrongPrincipal},
+			},
+		},
+		{
+			"expired ticket",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithClock[sshkrb5.Server](func() time.Time {
+					return time.Now().Add(2 * time.Hour)
+				}),
+			},
+			testService,
+			false,
+			false,
+			[]testEvent{
+				{sshkrb5.AuditAcceptSecContext, sshkrb5.ReasonTicketExpired},
+			},
+		},
+		{
+			"replay",
+			nil,
+			testService,
+			true,
+			false,
+			[]testEvent{
+				{sshkrb5.AuditAcceptSecContext, sshkrb5.ReasonNone},
+				{sshkrb5.AuditAcceptSecContext, sshkrb5.ReasonReplay},
+			},
+		},
+		{
+			"bad MIC",
+			nil,
+			testService,
+			false,
+			true,
+			[]testEvent{
+				{sshkrb5.AuditAcceptSecContext, sshkrb5.ReasonNone},
+				{sshkrb5.AuditVerifyMIC, sshkrb5.ReasonBadMIC},
+			},
+		},
+		{
+			"denied",
+			[]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithAllowedRealms("OTHER.COM"),
+			},
+			testService,
+			false,
+			false,
+			[]testEvent{
+				{sshkrb5.AuditAcceptSecContext, sshkrb5.ReasonNone},
+				{sshkrb5.AuditVerifyMIC, sshkrb5.ReasonNone},
+				{sshkrb5.AuditAllowLogin, sshkrb5.ReasonDenied},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			var events []sshkrb5.AuditEvent
+
+			options := append([]sshkrb5.Option[sshkrb5.Server]{
+				sshkrb5.WithKeytab[sshkrb5.Server](path),
+				sshkrb5.WithStrictMode(false),
+				sshkrb5.WithAuditHook[sshkrb5.Server](func(event sshkrb5.AuditEvent) {
+					events = append(events, event)
+				}),
+			}, table.options...)
+
+			server, err := sshkrb5.NewServer(options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Close()
+
+			initiator, token, err := newTestInitiator(kt, table.service, "test", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := server.NewContext()
+
+			_, name, cont, err := ctx.AcceptSecContext(token)
+			if err == nil && !cont {
+				if table.replay {
+					_, _, _, err = server.NewContext().AcceptSecContext(token)
+					assert.ErrorIs(t, err, sshkrb5.ErrReplay)
+				} else {
+					mic, err := initiator.getMIC([]byte("test"))
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if table.badMIC {
+						mic[len(mic)-1] ^= 0xff
+					}
+
+					if ctx.VerifyMIC([]byte("test"), mic) == nil {
+						_, _ = ctx.AllowLogin(testConnMetadata{user: "test"}, name)
+					}
+				}
+			}
+
+			actual := make([]testEvent, 0, len(events))
+
+			for _, event := range events {
+				assert.Equal(t, "gokrb5", event.Backend)
+				assert.Equal(t, event.Reason == sshkrb5.ReasonNone, event.Err == nil)
+
+				if event.Stage == sshkrb5.AuditAllowLogin {
+					assert.Equal(t, "test", event.User)
+					assert.Equal(t, "test@"+testRealm, event.Principal)
+				}
+
+				actual = append(actual, testEvent{event.Stage, event.Reason})
+			}
+
+			assert.Equal(t, table.events, actual)
+		})
+	}
+}
+
+func TestServerThrottling(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(
+		sshkrb5.WithKeytab[sshkrb5.Server](path),
+		sshkrb5.WithServicePrincipal(testService),
+		sshkrb5.WithAllowedRealms(testRealm),
+		sshkrb5.WithThrottling[sshkrb5.Server](2, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	var (
+		attacker = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 65535}
+		client   = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 65535}
+	)
+
+	// Tickets for the wrong service principal are refused
+	for range 2 {
+		_, token, err := newTestInitiator(kt, testAlias, "test", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, cont, err := server.NewContextWithRemoteAddr(attacker).AcceptSecContext(token)
+		assert.NoError(t, err)
+		assert.True(t, cont)
+	}
+
+	_, token, err := newTestInitiator(kt, testService, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Even a valid ticket is now refused from the same address, the port
+	// is ignored
+	_, _, _, err = server.NewContextWithRemoteAddr(&net.TCPAddr{IP: attacker.IP, Port: 1024}).AcceptSecContext(token)
+	assert.ErrorIs(t, err, sshkrb5.ErrThrottled)
+
+	// Another address isn't affected
+	ctx := server.NewContextWithRemoteAddr(client)
+	if err := testServerContext(ctx, kt, testService, "test", false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctx.AllowLogin(testConnMetadata{user: "test", remoteAddr: client}, "test@"+testRealm)
+	assert.NoError(t, err)
+
+	// Fail the principal twice from the other address
+	for range 2 {
+		_, err = ctx.AllowLogin(testConnMetadata{user: "test", remoteAddr: client}, "test@OTHER.COM")
+		assert.Error(t, err)
+	}
+
+	// The principal is now refused from any address
+	_, err = ctx.AllowLogin(testConnMetadata{user: "test", remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 4)}},
+		"test@OTHER.COM")
+	assert.ErrorIs(t, err, sshkrb5.ErrThrottled)
+}
+
+func TestServerThrottlingReplay(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(
+		sshkrb5.WithKeytab[sshkrb5.Server](path),
+		sshkrb5.WithServicePrincipal(testService),
+		sshkrb5.WithThrottling[sshkrb5.Server](2, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	_, token, err := newTestInitiator(kt, testService, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err = server.NewContext().AcceptSecContext(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replays are recorded against the principal even without the remote
+	// address
+	for range 2 {
+		_, _, _, err = server.NewContext().AcceptSecContext(token)
+		assert.ErrorIs(t, err, sshkrb5.ErrReplay)
+	}
+
+	_, _, _, err = server.NewContext().AcceptSecContext(token)
+	assert.ErrorIs(t, err, sshkrb5.ErrThrottled)
+
+	// Even a new ticket for the principal is now refused
+	_, token, err = newTestInitiator(kt, testService, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = server.NewContext().AcceptSecContext(token)
+	assert.ErrorIs(t, err, sshkrb5.ErrThrottled)
+
+	// Another principal isn't affected
+	if err := testServerContext(server.NewContext(), kt, testService, "other", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryThrottleStore(t *testing.T) {
+	t.Parallel()
+
+	store := sshkrb5.NewMemoryThrottleStore()
+
+	// Expiry is relative to the clock passed in, not the system clock
+	now := time.Now().Add(-time.Hour)
+
+	n, err := store.Fail("key", now, now.Add(-time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = store.Fail("key", now, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = store.Fail("key", now, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = store.Failures("key", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = store.Failures("key", now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, err = store.Fail("key", now, now.Add(time.Minute))
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Reset("key"))
+
+	n, err = store.Failures("key", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestMemoryThrottleStoreSweep(t *testing.T) {
+	t.Parallel()
+
+	store := sshkrb5.NewMemoryThrottleStore()
+	now := time.Now()
+
+	_, err := store.Fail("a", now, now.Add(time.Second))
+	assert.NoError(t, err)
+
+	// Expired keys linger until they're used or the next sweep
+	_, err = store.Fail("b", now.Add(2*time.Second), now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, store.Keys())
+
+	n, err := store.Failures("b", now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 0, store.Keys())
+}
+
+type testConn struct {
+	testConnMetadata
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newTestConn() *testConn {
+	return &testConn{
+		testConnMetadata: testConnMetadata{
+			user: "test",
+		},
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *testConn) SendRequest(_ string, _ bool, _ []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+
+func (c *testConn) OpenChannel(_ string, _ []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, nil
+}
+
+func (c *testConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	return nil
+}
+
+func (c *testConn) Wait() error {
+	<-c.closed
+
+	return nil
+}
+
+func TestServerContextCloseOnExpiry(t *testing.T) {
+	t.Parallel()
+
+	kt, path := newTestKeytab(t)
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytab[sshkrb5.Server](path), sshkrb5.WithStrictMode(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	ctx := server.NewContext()
+
+	_, err = ctx.Expiry()
+	assert.Error(t, err)
+	assert.Error(t, ctx.CloseOnExpiry(newTestConn()))
+
+	tkt, key, err := newTestTicketWithLifetime(kt, "test", testService, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiator, token, err := newTestAPReq(kt, tkt, key, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := ctx.AcceptSecContext(token); err != nil {
+		t.Fatal(err)
+	}
+
+	mic, err := initiator.getMIC([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.VerifyMIC([]byte("test"), mic); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry, err := ctx.Expiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Kerberos times only have a precision of a second
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), expiry, time.Second)
+
+	conn := newTestConn()
+
+	if err := ctx.CloseOnExpiry(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// A connection that is closed first doesn't get the callback
+	called := make(chan struct{})
+	other := newTestConn()
+
+	if err := ctx.AfterExpiry(other, func() { close(called) }); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = other.Close()
+
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	select {
+	case <-called:
+		t.Fatal("callback called after connection closed")
+	case <-time.After(100 * time.Millisecond):
+	}
 }
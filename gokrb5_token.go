@@ -0,0 +1,151 @@
+//go:build !windows && !apcera
+// +build !windows,!apcera
+
+package sshkrb5
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// These are a 1:1 copy of the types from github.com/jcmturner/gokrb5/v8
+// with marshalling methods added. If/when upstream adds the missing methods
+// these can be removed.
+
+type apRep struct {
+	PVNO    int                 `asn1:"explicit,tag:0"`
+	MsgType int                 `asn1:"explicit,tag:1"`
+	EncPart types.EncryptedData `asn1:"explicit,tag:2"`
+}
+
+func (a *apRep) marshal() ([]byte, error) {
+	b, err := asn1.Marshal(*a)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1tools.AddASNAppTag(b, asnAppTag.APREP), nil
+}
+
+type encAPRepPart struct {
+	CTime          time.Time           `asn1:"generalized,explicit,tag:0"`
+	Cusec          int                 `asn1:"explicit,tag:1"`
+	Subkey         types.EncryptionKey `asn1:"optional,explicit,tag:2"`
+	SequenceNumber int64               `asn1:"optional,explicit,tag:3"`
+}
+
+func (a *encAPRepPart) marshal() ([]byte, error) {
+	b, err := asn1.Marshal(*a)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1tools.AddASNAppTag(b, asnAppTag.EncAPRepPart), nil
+}
+
+func newAPRep(tkt messages.Ticket, sessionKey types.EncryptionKey, encPart encAPRepPart) (apRep, error) {
+	m, err := encPart.marshal()
+	if err != nil {
+		return apRep{}, krberror.Errorf(err, krberror.EncodingError, "marshaling error of AP-REP enc-part")
+	}
+
+	ed, err := crypto.GetEncryptedData(m, sessionKey, keyusage.AP_REP_ENCPART, tkt.EncPart.KVNO)
+	if err != nil {
+		return apRep{}, krberror.Errorf(err, krberror.EncryptingError, "error encrypting AP-REP enc-part")
+	}
+
+	return apRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: ed,
+	}, nil
+}
+
+// This is a 1:1 copy of the type from github.com/jcmturner/gokrb5/v8 with a
+// marshal method that supports all token IDs instead of just the AP-REQ, and
+// doesn't build the AP-REQ itself.
+// If/when upstream fixes this omission it can be removed.
+
+type krb5Token struct {
+	oid      asn1.ObjectIdentifier
+	tokID    []byte
+	apReq    *messages.APReq
+	apRep    *apRep
+	krbError *messages.KRBError
+}
+
+func newKRB5TokenAPREQ(apreq *messages.APReq) krb5Token {
+	tb, _ := hex.DecodeString(spnego.TOK_ID_KRB_AP_REQ)
+
+	return krb5Token{
+		oid:   gssapi.OIDKRB5.OID(),
+		tokID: tb,
+		apReq: apreq,
+	}
+}
+
+func newKRB5TokenAPREP(aprep *apRep) krb5Token {
+	tb, _ := hex.DecodeString(spnego.TOK_ID_KRB_AP_REP)
+
+	return krb5Token{
+		oid:   gssapi.OIDKRB5.OID(),
+		tokID: tb,
+		apRep: aprep,
+	}
+}
+
+func newKRB5TokenKRBError(krbError *messages.KRBError) krb5Token {
+	tb, _ := hex.DecodeString(spnego.TOK_ID_KRB_ERROR)
+
+	return krb5Token{
+		oid:      gssapi.OIDKRB5.OID(),
+		tokID:    tb,
+		krbError: krbError,
+	}
+}
+
+func (m *krb5Token) marshal() ([]byte, error) {
+	b, _ := asn1.Marshal(m.oid)
+	b = append(b, m.tokID...)
+
+	var (
+		tb  []byte
+		err error
+	)
+
+	switch hex.EncodeToString(m.tokID) {
+	case spnego.TOK_ID_KRB_AP_REQ:
+		tb, err = m.apReq.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling AP_REQ for MechToken: %w", err)
+		}
+	case spnego.TOK_ID_KRB_AP_REP:
+		tb, err = m.apRep.marshal()
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling AP_REP for MechToken: %w", err)
+		}
+	case spnego.TOK_ID_KRB_ERROR:
+		tb, err = m.krbError.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling KRB_ERROR for MechToken: %w", err)
+		}
+	}
+
+	b = append(b, tb...)
+
+	return asn1tools.AddASNAppTag(b, 0), nil
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package sshkrb5
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var errK5LoginOwner = errors.New(".k5login is not owned by the user or root")
+
+func checkK5LoginOwner(f *os.File, u *user.User) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	if st.Uid == 0 || strconv.FormatUint(uint64(st.Uid), 10) == u.Uid {
+		return nil
+	}
+
+	return errK5LoginOwner
+}
@@ -0,0 +1,10 @@
+package sshkrb5
+
+import (
+	"os"
+	"os/user"
+)
+
+func checkK5LoginOwner(_ *os.File, _ *user.User) error {
+	return nil
+}
@@ -0,0 +1,52 @@
+package sshkrb5
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrNoKeytab is returned by NewServer when the keytab can't be found.
+	ErrNoKeytab = errors.New("keytab not found")
+	// ErrNoKey is returned by NewServer when the keytab has no key for a
+	// service principal.
+	ErrNoKey = errors.New("no key in keytab")
+	// ErrWeakKey is returned by NewServer when the keytab only has keys
+	// for a service principal using weak encryption types such as RC4 or
+	// triple DES, unless WithWeakKeys(true) is used.
+	ErrWeakKey = errors.New("only weak keys in keytab")
+)
+
+// KeytabError is returned by NewServer when the keytab can't be used to
+// accept tickets.
+type KeytabError struct {
+	// Path is the path to the keytab, empty if it was passed in memory or
+	// couldn't be found.
+	Path string
+	// Principal is the service principal, empty if the error is with the
+	// keytab as a whole.
+	Principal string
+	Err       error
+}
+
+func (e *KeytabError) Error() string {
+	var b strings.Builder
+
+	b.WriteString("keytab")
+
+	if e.Path != "" {
+		b.WriteString(" " + e.Path)
+	}
+
+	if e.Principal != "" {
+		b.WriteString(" for " + e.Principal)
+	}
+
+	b.WriteString(": " + e.Err.Error())
+
+	return b.String()
+}
+
+func (e *KeytabError) Unwrap() error {
+	return e.Err
+}
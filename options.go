@@ -3,16 +3,18 @@ package sshkrb5
 import "github.com/go-logr/logr"
 
 // Option is the signature for all constructor options.
-type Option[T Client | Server] func(*T) error
+type Option[T Client | Server | Authorizer] func(*T) error
 
-// WithLogger configures a logr.Logger in a Server.
-func WithLogger[T Client | Server](logger logr.Logger) Option[T] {
+// WithLogger configures a logr.Logger in a Client, Server or Authorizer.
+func WithLogger[T Client | Server | Authorizer](logger logr.Logger) Option[T] {
 	return func(a *T) error {
 		switch x := any(a).(type) {
 		case *Client:
 			x.logger = logger.WithName("client")
 		case *Server:
 			x.logger = logger.WithName("server")
+		case *Authorizer:
+			x.logger = logger.WithName("authorizer")
 		}
 
 		return nil
@@ -3,6 +3,11 @@
 
 package sshkrb5
 
+import (
+	"fmt"
+	"strings"
+)
+
 // WithStrictMode is the equivalent of GSSAPIStrictAcceptorCheck.
 func WithStrictMode[T Server](strict bool) Option[T] {
 	return func(a *T) error {
@@ -13,3 +18,51 @@ func WithStrictMode[T Server](strict bool) Option[T] {
 		return nil
 	}
 }
+
+// WithServicePrincipal sets the service principals, in the form
+// service/hostname, that clients are allowed to authenticate against. It can
+// be used more than once. When set, the principals replace the default of
+// host/ plus the hostname used in strict mode, and are enforced regardless of
+// strict mode.
+func WithServicePrincipal[T Server](principals ...string) Option[T] {
+	return func(a *T) error {
+		for _, principal := range principals {
+			service, hostname, ok := strings.Cut(principal, "/")
+			if !ok || service == "" || hostname == "" || strings.ContainsAny(hostname, "/@") {
+				return fmt.Errorf("%w: %s", errBadPrincipal, principal)
+			}
+		}
+
+		if x, ok := any(a).(*Server); ok {
+			x.principals = append(x.principals, principals...)
+		}
+
+		return nil
+	}
+}
+
+// WithServerIdentity is the equivalent of GSSAPIServerIdentity. It sets the
+// service principal, in the form service/hostname, that the Client requests
+// a ticket for instead of using the target hostname, which is useful when
+// connecting through a port-forward or a virtual IP. A hostname on its own
+// uses the host service. Hostname canonicalisation isn't applied to it.
+func WithServerIdentity[T Client](identity string) Option[T] {
+	return func(a *T) error {
+		principal := identity
+		if !strings.Contains(principal, "/") {
+			principal = "host/" + principal
+		}
+
+		service, hostname, ok := strings.Cut(principal, "/")
+		if !ok || service == "" || hostname == "" || strings.Contains(service, "@") ||
+			strings.ContainsAny(hostname, "/@") {
+			return fmt.Errorf("%w: %s", errBadPrincipal, identity)
+		}
+
+		if x, ok := any(a).(*Client); ok {
+			x.serverIdentity = service + "@" + hostname
+		}
+
+		return nil
+	}
+}
@@ -4,3 +4,16 @@ package sshkrb5
 func WithStrictMode[T Server](_ bool) Option[T] {
 	return unsupportedOption[T]
 }
+
+// WithServicePrincipal sets the service principals, in the form
+// service/hostname, that clients are allowed to authenticate against.
+func WithServicePrincipal[T Server](_ ...string) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithServerIdentity is the equivalent of GSSAPIServerIdentity. It sets the
+// service principal, in the form service/hostname, that the Client requests
+// a ticket for instead of using the target hostname.
+func WithServerIdentity[T Client](_ string) Option[T] {
+	return unsupportedOption[T]
+}
@@ -0,0 +1,64 @@
+package sshkrb5
+
+import (
+	"strings"
+)
+
+// LogonInfo is the logon information decoded from the Microsoft PAC
+// carried in tickets issued by Active Directory.
+type LogonInfo struct {
+	// Username is the account name, also known as the sAMAccountName.
+	Username string
+	// FullName is the display name of the account.
+	FullName string
+	// Domain is the NetBIOS name of the domain of the account.
+	Domain string
+	// DomainSID is the SID of the domain of the account.
+	DomainSID string
+	// UserSID is the SID of the account.
+	UserSID string
+	// PrimaryGroupSID is the SID of the primary group of the account.
+	PrimaryGroupSID string
+	// GroupSIDs are the SIDs of every group the account is a member of.
+	GroupSIDs []string
+	// LogonServer is the name of the domain controller that authenticated
+	// the account.
+	LogonServer string
+	// UPN is the user principal name of the account, if known.
+	UPN string
+	// DNSDomain is the DNS name of the domain of the account, if known.
+	DNSDomain string
+}
+
+// MemberOf returns whether the account is a member of at least one of the
+// groups identified by SID.
+func (l *LogonInfo) MemberOf(sids ...string) bool {
+	for _, sid := range sids {
+		if strings.EqualFold(sid, l.PrimaryGroupSID) {
+			return true
+		}
+
+		for _, group := range l.GroupSIDs {
+			if strings.EqualFold(sid, group) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// WithAllowedGroups sets the Active Directory groups, identified by SID,
+// that principals must be a member of at least one of in the Server. Group
+// membership is taken from the PAC in the ticket so principals without one
+// are denied, as are tickets with a PAC that can't be verified. Only the
+// default backend decodes the PAC. It can be used more than once.
+func WithAllowedGroups[T Server](sids ...string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.policy.groups = append(x.policy.groups, sids...)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package sshkrb5
+
+import (
+	"strings"
+	"time"
+)
+
+// PeerInfo describes the principal authenticated by a security context.
+// Anything the backend can't determine is left as the zero value.
+type PeerInfo struct {
+	// Principal is the full principal name as returned by
+	// AcceptSecContext.
+	Principal string
+	// Primary is the first component of the principal name.
+	Primary string
+	// Instance is any remaining components of the principal name.
+	Instance string
+	// Realm is the realm of the principal.
+	Realm string
+
+	// AuthTime is when the principal initially authenticated.
+	AuthTime time.Time
+	// StartTime is when the ticket became valid.
+	StartTime time.Time
+	// EndTime is when the ticket expires.
+	EndTime time.Time
+
+	// EncType is the encryption type of the session key, see
+	// github.com/jcmturner/gokrb5/v8/iana/etypeID for the values.
+	EncType int32
+	// Flags are the ticket flags, use HasFlag to test them.
+	Flags uint32
+
+	// Delegated is whether the client delegated credentials.
+	Delegated bool
+
+	// LogonInfo is the logon information from the PAC in the ticket, it is
+	// nil if the ticket didn't contain a PAC with logon information that
+	// could be verified.
+	LogonInfo *LogonInfo
+}
+
+// HasFlag returns whether the ticket flag is set, see
+// github.com/jcmturner/gokrb5/v8/iana/flags for the values.
+func (p *PeerInfo) HasFlag(flag int) bool {
+	if flag < 0 || flag > 31 {
+		return false
+	}
+
+	// Flags use the RFC 4120 bit numbering where 0 is the most significant
+	return p.Flags&(1<<(31-flag)) != 0
+}
+
+// newPeerInfo returns a PeerInfo with the principal name parsed into its
+// parts. Both user/instance@REALM and DOMAIN\user forms are accepted.
+func newPeerInfo(principal string) *PeerInfo {
+	p := &PeerInfo{
+		Principal: principal,
+	}
+
+	if domain, user, ok := strings.Cut(principal, `\`); ok {
+		p.Primary, p.Realm = user, domain
+
+		return p
+	}
+
+	components, realm := splitPrincipal(principal)
+
+	p.Primary, p.Instance, p.Realm = components[0], strings.Join(components[1:], "/"), realm
+
+	return p
+}
+
+// PeerInfo returns details of the principal authenticated by the default
+// security context once it has been established.
+func (s *Server) PeerInfo() (*PeerInfo, error) {
+	return s.defaultContext.PeerInfo()
+}
@@ -0,0 +1,229 @@
+package sshkrb5
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errDenied     = errors.New("login denied")
+	errBadPattern = errors.New("invalid principal pattern")
+)
+
+// WithAllowedRealms sets the realms that principals must belong to in the
+// Server. It can be used more than once.
+func WithAllowedRealms[T Server](realms ...string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.policy.realms = append(x.policy.realms, realms...)
+		}
+
+		return nil
+	}
+}
+
+// WithAllowedPrincipals sets the patterns that principals must match at
+// least one of in the Server. A pattern is matched against the whole
+// principal including the realm, * matches any sequence of characters and ?
+// matches a single character. It can be used more than once.
+func WithAllowedPrincipals[T Server](patterns ...string) Option[T] {
+	return func(a *T) error {
+		compiled, err := compilePatterns(patterns)
+		if err != nil {
+			return err
+		}
+
+		if x, ok := any(a).(*Server); ok {
+			x.policy.allowed = append(x.policy.allowed, compiled...)
+		}
+
+		return nil
+	}
+}
+
+// WithDeniedPrincipals sets the patterns that principals must not match in
+// the Server. Patterns are the same as for WithAllowedPrincipals and denied
+// patterns take precedence over allowed ones. It can be used more than once.
+func WithDeniedPrincipals[T Server](patterns ...string) Option[T] {
+	return func(a *T) error {
+		compiled, err := compilePatterns(patterns)
+		if err != nil {
+			return err
+		}
+
+		if x, ok := any(a).(*Server); ok {
+			x.policy.denied = append(x.policy.denied, compiled...)
+		}
+
+		return nil
+	}
+}
+
+// WithUserPrincipals sets the patterns that principals must match at least
+// one of to log in as the SSH user in the Server. Users without any patterns
+// are not restricted. Patterns are the same as for WithAllowedPrincipals. It
+// can be used more than once.
+func WithUserPrincipals[T Server](user string, patterns ...string) Option[T] {
+	return func(a *T) error {
+		compiled, err := compilePatterns(patterns)
+		if err != nil {
+			return err
+		}
+
+		if x, ok := any(a).(*Server); ok {
+			if x.policy.users == nil {
+				x.policy.users = make(map[string][]principalPattern)
+			}
+
+			x.policy.users[user] = append(x.policy.users[user], compiled...)
+		}
+
+		return nil
+	}
+}
+
+// WithAuthorizer sets an Authorizer in the Server which is consulted by
+// AllowLogin once the principal has satisfied the policy.
+func WithAuthorizer[T Server](authorizer *Authorizer) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.policy.authorizer = authorizer
+		}
+
+		return nil
+	}
+}
+
+// AllowLogin can be used as the AllowLogin function of
+// ssh.GSSAPIWithMICConfig. It enforces the realms, principal patterns and
+// groups set on the Server followed by any Authorizer. Group membership is
+// taken from the default security context. The error describes why the login
+// was denied.
+func (s *Server) AllowLogin(conn ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+	return s.defaultContext.AllowLogin(conn, srcName)
+}
+
+// AllowLogin is the same as Server.AllowLogin except group membership is
+// taken from this security context.
+func (c *ServerContext) AllowLogin(conn ssh.ConnMetadata, srcName string) (_ *ssh.Permissions, err error) {
+	s := c.server
+
+	defer func(start time.Time) {
+		s.auditAllowLogin(start, conn, srcName, err)
+	}(time.Now())
+
+	if err = s.throttle.check(srcName, conn.RemoteAddr(), s.now()); err != nil {
+		return nil, err
+	}
+
+	// Only trust the peer details if they're for the same principal
+	info, err := c.PeerInfo()
+	if err != nil || info.Principal != srcName {
+		info = nil
+	}
+
+	if err = s.policy.check(srcName, conn.User(), info); err != nil {
+		return nil, err
+	}
+
+	if s.policy.authorizer != nil {
+		return s.policy.authorizer.AllowLogin(conn, srcName)
+	}
+
+	return &ssh.Permissions{}, nil
+}
+
+type principalPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func compilePatterns(patterns []string) ([]principalPattern, error) {
+	compiled := make([]principalPattern, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return nil, errBadPattern
+		}
+
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errBadPattern, pattern, err)
+		}
+
+		compiled = append(compiled, principalPattern{
+			pattern: pattern,
+			re:      re,
+		})
+	}
+
+	return compiled, nil
+}
+
+func matchPatterns(patterns []principalPattern, principal string) (string, bool) {
+	for _, p := range patterns {
+		if p.re.MatchString(principal) {
+			return p.pattern, true
+		}
+	}
+
+	return "", false
+}
+
+// policy is the set of rules a principal must satisfy to log in.
+type policy struct {
+	realms     []string
+	allowed    []principalPattern
+	denied     []principalPattern
+	users      map[string][]principalPattern
+	groups     []string
+	authorizer *Authorizer
+}
+
+//nolint:cyclop
+func (p *policy) check(principal, user string, info *PeerInfo) error {
+	name := newPeerInfo(principal)
+	if name.Realm == "" || name.Primary == "" {
+		return fmt.Errorf("%w: malformed principal %q", errDenied, principal)
+	}
+
+	if len(p.realms) > 0 && !slices.Contains(p.realms, name.Realm) {
+		return fmt.Errorf("%w: realm %s of %s is not allowed", errDenied, name.Realm, principal)
+	}
+
+	if pattern, ok := matchPatterns(p.denied, principal); ok {
+		return fmt.Errorf("%w: %s matches denied pattern %s", errDenied, principal, pattern)
+	}
+
+	if _, ok := matchPatterns(p.allowed, principal); len(p.allowed) > 0 && !ok {
+		return fmt.Errorf("%w: %s does not match any allowed pattern", errDenied, principal)
+	}
+
+	if patterns, ok := p.users[user]; ok {
+		if _, ok := matchPatterns(patterns, principal); !ok {
+			return fmt.Errorf("%w: %s is not allowed to log in as %s", errDenied, principal, user)
+		}
+	}
+
+	if len(p.groups) > 0 {
+		if info == nil || info.LogonInfo == nil {
+			return fmt.Errorf("%w: %s has no group membership information", errDenied, principal)
+		}
+
+		if !info.LogonInfo.MemberOf(p.groups...) {
+			return fmt.Errorf("%w: %s is not a member of any allowed group", errDenied, principal)
+		}
+	}
+
+	return nil
+}
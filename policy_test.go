@@ -0,0 +1,205 @@
+package sshkrb5_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bodgit/sshkrb5"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConnMetadata struct {
+	user       string
+	remoteAddr net.Addr
+}
+
+func (c testConnMetadata) User() string {
+	return c.user
+}
+
+func (c testConnMetadata) SessionID() []byte {
+	return nil
+}
+
+func (c testConnMetadata) ClientVersion() []byte {
+	return nil
+}
+
+func (c testConnMetadata) ServerVersion() []byte {
+	return nil
+}
+
+func (c testConnMetadata) RemoteAddr() net.Addr {
+	if c.remoteAddr == nil {
+		return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 65535}
+	}
+
+	return c.remoteAddr
+}
+
+func (c testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22}
+}
+
+func TestServerAllowLogin(t *testing.T) {
+	t.Parallel()
+
+	server, err := sshkrb5.NewServer(
+		sshkrb5.WithKeytabValidation(false),
+		sshkrb5.WithAllowedRealms("EXAMPLE.COM", "CORP.EXAMPLE.COM"),
+		sshkrb5.WithAllowedPrincipals("*@EXAMPLE.COM", "svc-?@CORP.EXAMPLE.COM"),
+		sshkrb5.WithDeniedPrincipals("*/admin@*"),
+		sshkrb5.WithUserPrincipals("root", "alice@EXAMPLE.COM", "bob@EXAMPLE.COM"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	tables := []struct {
+		name      string
+		user      string
+		principal string
+		reason    string
+	}{
+		{
+			"allowed",
+			"alice",
+			"alice@EXAMPLE.COM",
+			"",
+		},
+		{
+			"allowed pattern",
+			"svc",
+			"svc-1@CORP.EXAMPLE.COM",
+			"",
+		},
+		{
+			"malformed",
+			"alice",
+			"alice",
+			`login denied: malformed principal "alice"`,
+		},
+		{
+			"realm",
+			"alice",
+			"alice@OTHER.COM",
+			"login denied: realm OTHER.COM of alice@OTHER.COM is not allowed",
+		},
+		{
+			"denied pattern",
+			"alice",
+			"alice/admin@EXAMPLE.COM",
+			"login denied: alice/admin@EXAMPLE.COM matches denied pattern */admin@*",
+		},
+		{
+			"no allowed pattern",
+			"svc",
+			"svc-10@CORP.EXAMPLE.COM",
+			"login denied: svc-10@CORP.EXAMPLE.COM does not match any allowed pattern",
+		},
+		{
+			"user allowed",
+			"root",
+			"bob@EXAMPLE.COM",
+			"",
+		},
+		{
+			"user denied",
+			"root",
+			"carol@EXAMPLE.COM",
+			"login denied: carol@EXAMPLE.COM is not allowed to log in as root",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := server.AllowLogin(testConnMetadata{user: table.user}, table.principal)
+			if table.reason == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, table.reason)
+			}
+		})
+	}
+}
+
+func TestServerAllowLoginDomainUser(t *testing.T) {
+	t.Parallel()
+
+	server, err := sshkrb5.NewServer(
+		sshkrb5.WithKeytabValidation(false),
+		sshkrb5.WithAllowedRealms("EXAMPLE"),
+		sshkrb5.WithDeniedPrincipals(`EXAMPLE\bob`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	tables := []struct {
+		name      string
+		principal string
+		reason    string
+	}{
+		{
+			"allowed",
+			`EXAMPLE\alice`,
+			"",
+		},
+		{
+			"malformed",
+			`EXAMPLE\`,
+			`login denied: malformed principal "EXAMPLE\\"`,
+		},
+		{
+			"realm",
+			`OTHER\alice`,
+			`login denied: realm OTHER of OTHER\alice is not allowed`,
+		},
+		{
+			"denied pattern",
+			`EXAMPLE\bob`,
+			`login denied: EXAMPLE\bob matches denied pattern EXAMPLE\bob`,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := server.AllowLogin(testConnMetadata{user: "alice"}, table.principal)
+			if table.reason == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, table.reason)
+			}
+		})
+	}
+}
+
+func TestServerAllowLoginAuthorizer(t *testing.T) {
+	t.Parallel()
+
+	authorizer, err := sshkrb5.NewAuthorizer(sshkrb5.WithLocalRealm("EXAMPLE.COM"), sshkrb5.WithK5Login(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := sshkrb5.NewServer(sshkrb5.WithKeytabValidation(false), sshkrb5.WithAuthorizer(authorizer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	_, err = server.AllowLogin(testConnMetadata{user: "alice"}, "alice@EXAMPLE.COM")
+	assert.NoError(t, err)
+
+	_, err = server.AllowLogin(testConnMetadata{user: "bob"}, "alice@EXAMPLE.COM")
+	assert.Error(t, err)
+}
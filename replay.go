@@ -0,0 +1,68 @@
+package sshkrb5
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrReplay is returned when an authenticator has already been seen by a
+// ReplayCache.
+var ErrReplay = errors.New("request is a replay")
+
+// ReplayCache records the authenticators received by a Server so that a
+// captured token can't be replayed while it would otherwise still be valid.
+type ReplayCache interface {
+	// Add records the authenticator identified by id until it expires. It
+	// returns ErrReplay if the authenticator has already been recorded
+	// and hasn't yet expired. now is the current time according to the
+	// Server and should be used rather than the system clock to decide
+	// whether entries have expired.
+	Add(id string, now, expires time.Time) error
+}
+
+// replaySweepInterval is how often a MemoryReplayCache removes expired
+// entries.
+const replaySweepInterval = time.Minute
+
+// MemoryReplayCache is a ReplayCache for a single process.
+type MemoryReplayCache struct {
+	mu        sync.Mutex
+	entries   map[string]time.Time
+	nextSweep time.Time
+}
+
+// NewMemoryReplayCache returns a new MemoryReplayCache.
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		entries: make(map[string]time.Time),
+	}
+}
+
+// Add records the authenticator identified by id until it expires.
+func (c *MemoryReplayCache) Add(id string, now, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.entries[id]; ok && now.Before(t) {
+		return ErrReplay
+	}
+
+	c.entries[id] = expires
+
+	// Expired entries are only removed occasionally so each call doesn't
+	// have to scan the whole cache
+	if now.Before(c.nextSweep) {
+		return nil
+	}
+
+	for k, t := range c.entries {
+		if !now.Before(t) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.nextSweep = now.Add(replaySweepInterval)
+
+	return nil
+}
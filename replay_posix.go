@@ -0,0 +1,90 @@
+//go:build !windows
+// +build !windows
+
+package sshkrb5
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// FileReplayCache is a ReplayCache that can be shared by several processes
+// on the same host. Access to the file is serialised with an advisory lock.
+type FileReplayCache struct {
+	path string
+}
+
+// NewFileReplayCache returns a new FileReplayCache using the file at path,
+// which is created if necessary.
+func NewFileReplayCache(path string) *FileReplayCache {
+	return &FileReplayCache{
+		path: path,
+	}
+}
+
+// Add records the authenticator identified by id until it expires.
+func (c *FileReplayCache) Add(id string, now, expires time.Time) (err error) {
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err = multierror.Append(err, f.Close()).ErrorOrNil()
+	}()
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil { //nolint:gosec
+		return err
+	}
+
+	defer func() {
+		err = multierror.Append(err, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)).ErrorOrNil() //nolint:gosec
+	}()
+
+	var (
+		buf     = new(bytes.Buffer)
+		scanner = bufio.NewScanner(f)
+	)
+
+	// Each line is the expiry as Unix nanoseconds followed by the id,
+	// expired entries are dropped as the file is rewritten
+	for scanner.Scan() {
+		s, entry, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		n, parseErr := strconv.ParseInt(s, 10, 64)
+		if parseErr != nil || !now.Before(time.Unix(0, n)) {
+			continue
+		}
+
+		if entry == id {
+			return ErrReplay
+		}
+
+		fmt.Fprintln(buf, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(buf, expires.UnixNano(), id)
+
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(buf.Bytes(), 0)
+
+	return err
+}
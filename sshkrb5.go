@@ -12,6 +12,8 @@ import (
 //nolint:nolintlint,unused
 var (
 	errNotSupported = errors.New("not supported")
+	errNoContext    = errors.New("no security context")
+	errBadPrincipal = errors.New("invalid service principal")
 	osHostname      = os.Hostname //nolint:gochecknoglobals
 )
 
@@ -234,17 +234,6 @@ func newServer(ctx context.Context, hostname string, logger logr.Logger) (string
 		return "", nil, err
 	}
 
-	config := &ssh.ServerConfig{
-		GSSAPIWithMICConfig: &ssh.GSSAPIWithMICConfig{
-			AllowLogin: func(_ ssh.ConnMetadata, _ string) (*ssh.Permissions, error) {
-				return nil, nil //nolint:nilnil
-			},
-			Server: gssapi,
-		},
-	}
-
-	config.AddHostKey(private)
-
 	listener, err := new(net.ListenConfig).Listen(ctx, "tcp4", net.JoinHostPort(hostname, "0"))
 	if err != nil {
 		return "", nil, multierror.Append(err, gssapi.Close())
@@ -257,6 +246,17 @@ func newServer(ctx context.Context, hostname string, logger logr.Logger) (string
 				continue
 			}
 
+			config := &ssh.ServerConfig{
+				GSSAPIWithMICConfig: &ssh.GSSAPIWithMICConfig{
+					AllowLogin: func(_ ssh.ConnMetadata, _ string) (*ssh.Permissions, error) {
+						return nil, nil //nolint:nilnil
+					},
+					Server: gssapi.NewContext(),
+				},
+			}
+
+			config.AddHostKey(private)
+
 			_, chans, reqs, err := ssh.NewServerConn(conn, config)
 			if err != nil {
 				continue
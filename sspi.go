@@ -4,12 +4,31 @@
 package sshkrb5
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alexbrainman/sspi"
 	"github.com/alexbrainman/sspi/kerberos"
 	"github.com/go-logr/logr"
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+const backend = "sspi"
+
+// SSPI status codes not defined by github.com/alexbrainman/sspi.
+const (
+	secEInvalidToken   syscall.Errno = 0x80090308
+	secEMessageAltered syscall.Errno = 0x8009030f
+	secEWrongPrincipal syscall.Errno = 0x80090322
+	secETimeSkew       syscall.Errno = 0x80090324
 )
 
 // WithConfig sets the configuration in the Client.
@@ -55,20 +74,105 @@ func WithKeytab[T Client | Server](_ string) Option[T] {
 	return unsupportedOption[T]
 }
 
+// WithKeytabBytes sets the keytab contents in either a Client or Server.
+func WithKeytabBytes[T Client | Server](_ []byte) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithParsedKeytab sets the keytab in either a Client or Server.
+func WithParsedKeytab[T Client | Server](_ *keytab.Keytab) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithClockSkew sets the maximum permitted clock skew in either a Client or
+// Server.
+func WithClockSkew[T Client | Server](_ time.Duration) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithClock sets the source of the current time in either a Client or
+// Server.
+func WithClock[T Client | Server](_ func() time.Time) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithCCache sets the credentials cache in the Client.
+func WithCCache[T Client](_ string) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithCCacheBytes sets the credentials cache contents in the Client.
+func WithCCacheBytes[T Client](_ []byte) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithCCachePrincipal sets the principal in the Client whose credentials
+// cache is used from a collection.
+func WithCCachePrincipal[T Client](_ string) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithStoreCCache sets a credentials cache file in the Client that tickets
+// are stored in.
+func WithStoreCCache[T Client](_ string) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithReplayCache sets the ReplayCache in the Server.
+func WithReplayCache[T Server](_ ReplayCache) Option[T] {
+	return unsupportedOption[T]
+}
+
+// WithKeytabValidation sets whether NewServer checks the keytab. There is no
+// keytab, the credentials of the computer account are always acquired by
+// NewServer so this has no effect.
+func WithKeytabValidation[T Server](_ bool) Option[T] {
+	return func(*T) error {
+		return nil
+	}
+}
+
+// WithWeakKeys sets whether NewServer accepts a keytab that only has weak
+// keys. There is no keytab so this has no effect.
+func WithWeakKeys[T Server](_ bool) Option[T] {
+	return func(*T) error {
+		return nil
+	}
+}
+
 // Client implements the ssh.GSSAPIClient interface.
+//
+// The ssh.GSSAPIClient methods on Client share a single security context so
+// a Client used directly can only safely make one connection at a time. Use
+// NewContext to create an isolated ClientContext for each connection, which
+// all share the credentials of the Client.
 type Client struct {
 	domain   string
 	username string
 	password string
 
-	creds *sspi.Credentials
-	ctx   *kerberos.ClientContext
+	creds      *sspi.Credentials
+	delegation DelegationPolicy
+
+	canonicalizer
+
+	// exchanges tracks calls that may still be waiting for the KDC after
+	// being abandoned
+	exchanges sync.WaitGroup
+
+	defaultContext *ClientContext
 
 	logger logr.Logger
 }
 
-// NewClient returns a new Client using the current user.
-func NewClient(options ...Option[Client]) (*Client, error) {
+// NewClientContext returns a new Client using the current user. The
+// credentials are acquired without contacting the KDC so ctx is only checked
+// before starting.
+func NewClientContext(ctx context.Context, options ...Option[Client]) (*Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errAbandoned, err)
+	}
+
 	c := &Client{
 		logger: logr.Discard(),
 	}
@@ -91,18 +195,70 @@ func NewClient(options ...Option[Client]) (*Client, error) {
 		return nil, err
 	}
 
+	c.defaultContext = c.NewContext()
+
 	return c, nil
 }
 
+// NewContext returns a new ClientContext that shares the credentials of the
+// Client but has its own security context.
+func (c *Client) NewContext() *ClientContext {
+	return &ClientContext{
+		client:       c,
+		handshakeCtx: context.Background(),
+	}
+}
+
 // Close deletes any active security context and unloads any underlying
 // libraries as necessary.
 func (c *Client) Close() error {
+	c.exchanges.Wait()
+
 	return multierror.Append(c.DeleteSecContext(), c.creds.Release()).ErrorOrNil()
 }
 
 // InitSecContext is called by the ssh.Client to initialise or advance the
 // security context.
 func (c *Client) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	return c.defaultContext.InitSecContext(target, token, isGSSDelegCreds)
+}
+
+// GetMIC is called by the ssh.Client to authenticate the user using the
+// negotiated security context.
+func (c *Client) GetMIC(micField []byte) ([]byte, error) {
+	return c.defaultContext.GetMIC(micField)
+}
+
+// DeleteSecContext is called by the ssh.Client to tear down any active
+// security context.
+func (c *Client) DeleteSecContext() error {
+	return c.defaultContext.DeleteSecContext()
+}
+
+func (c *Client) usePassword() bool {
+	return c.domain != "" && c.username != "" && c.password != ""
+}
+
+// ClientContext implements the ssh.GSSAPIClient interface for a single
+// connection.
+type ClientContext struct {
+	client       *Client
+	handshakeCtx context.Context //nolint:containedctx
+	// target is the canonicalised target
+	target string
+
+	ctx *kerberos.ClientContext
+}
+
+// InitSecContext is called by the ssh.Client to initialise or advance the
+// security context.
+func (c *ClientContext) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	if len(token) == 0 || c.target == "" {
+		c.target = c.client.canonicalTarget(c.handshakeCtx, target, c.client.logger)
+	}
+
+	target = c.target
+
 	var (
 		completed bool
 		output    []byte
@@ -111,15 +267,35 @@ func (c *Client) InitSecContext(target string, token []byte, isGSSDelegCreds boo
 
 	if len(token) == 0 {
 		sspiFlags := uint32(sspi.ISC_REQ_MUTUAL_AUTH | sspi.ISC_REQ_CONNECTION | sspi.ISC_REQ_INTEGRITY)
-		if isGSSDelegCreds {
+		// Windows only delegates to services trusted for delegation so
+		// DelegateAlways behaves the same as DelegateOKAsDelegate
+		if c.client.delegation.delegate(isGSSDelegCreds) {
 			sspiFlags |= sspi.ISC_REQ_DELEGATE
 		}
 
-		//nolint:lll
-		c.ctx, completed, output, err = kerberos.NewClientContextWithFlags(c.creds, strings.ReplaceAll(target, "@", "/"), sspiFlags)
+		type result struct {
+			ctx       *kerberos.ClientContext
+			completed bool
+			output    []byte
+		}
+
+		var r result
+
+		// Creating the context requests the service ticket from the KDC,
+		// any context created after giving up is released
+		r, err = withContext(c.handshakeCtx, &c.client.exchanges, func() (result, error) {
+			ctx, completed, output, err := kerberos.NewClientContextWithFlags(c.client.creds,
+				strings.ReplaceAll(target, "@", "/"), sspiFlags)
+
+			return result{ctx, completed, output}, err
+		}, func(r result) {
+			_ = r.ctx.Release()
+		})
 		if err != nil {
 			return nil, false, err
 		}
+
+		c.ctx, completed, output = r.ctx, r.completed, r.output
 	} else {
 		completed, output, err = c.ctx.Update(token)
 	}
@@ -133,13 +309,13 @@ func (c *Client) InitSecContext(target string, token []byte, isGSSDelegCreds boo
 
 // GetMIC is called by the ssh.Client to authenticate the user using the
 // negotiated security context.
-func (c *Client) GetMIC(micField []byte) ([]byte, error) {
+func (c *ClientContext) GetMIC(micField []byte) ([]byte, error) {
 	return c.ctx.MakeSignature(micField, 0, 0)
 }
 
 // DeleteSecContext is called by the ssh.Client to tear down any active
 // security context.
-func (c *Client) DeleteSecContext() error {
+func (c *ClientContext) DeleteSecContext() error {
 	var err error
 
 	if c.ctx != nil {
@@ -150,14 +326,20 @@ func (c *Client) DeleteSecContext() error {
 	return err
 }
 
-func (c *Client) usePassword() bool {
-	return c.domain != "" && c.username != "" && c.password != ""
-}
-
 // Server implements the ssh.GSSAPIServer interface.
+//
+// The ssh.GSSAPIServer methods on Server share a single security context so
+// a Server used directly can only safely handle one connection at a time.
+// Use NewContext to create an isolated ServerContext for each connection.
 type Server struct {
 	creds *sspi.Credentials
-	ctx   *kerberos.ServerContext
+	now   func() time.Time
+
+	policy    policy
+	auditHook func(AuditEvent)
+	throttle  throttle
+
+	defaultContext *ServerContext
 
 	logger logr.Logger
 }
@@ -165,6 +347,7 @@ type Server struct {
 // NewServer returns a new Server.
 func NewServer(options ...Option[Server]) (*Server, error) {
 	s := &Server{
+		now:    time.Now,
 		logger: logr.Discard(),
 	}
 
@@ -180,10 +363,19 @@ func NewServer(options ...Option[Server]) (*Server, error) {
 	}
 
 	s.creds = creds
+	s.defaultContext = s.NewContext()
 
 	return s, nil
 }
 
+// NewContext returns a new ServerContext that shares the configuration of
+// the Server but has its own security context.
+func (s *Server) NewContext() *ServerContext {
+	return &ServerContext{
+		server: s,
+	}
+}
+
 // Close deletes any active security context and unloads any underlying
 // libraries as necessary.
 func (s *Server) Close() error {
@@ -193,28 +385,83 @@ func (s *Server) Close() error {
 // AcceptSecContext is called by the ssh.ServerConn to accept and advance the
 // security context.
 func (s *Server) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
+	return s.defaultContext.AcceptSecContext(token)
+}
+
+// VerifyMIC is called by the ssh.ServerConn to authenticate the user using
+// the negotiated security context.
+func (s *Server) VerifyMIC(micField, micToken []byte) error {
+	return s.defaultContext.VerifyMIC(micField, micToken)
+}
+
+// DeleteSecContext is called by the ssh.ServerConn to tear down any active
+// security context.
+func (s *Server) DeleteSecContext() error {
+	return s.defaultContext.DeleteSecContext()
+}
+
+// ServerContext implements the ssh.GSSAPIServer interface for a single
+// connection.
+type ServerContext struct {
+	server *Server
+
+	ctx      *kerberos.ServerContext
+	peerInfo *PeerInfo
+
+	remoteAddr net.Addr
+}
+
+// AcceptSecContext is called by the ssh.ServerConn to accept and advance the
+// security context.
+func (c *ServerContext) AcceptSecContext(token []byte) (_ []byte, username string, cont bool, err error) {
+	defer func(start time.Time) {
+		if err == nil && cont {
+			return
+		}
+
+		c.server.audit(AuditEvent{
+			Stage:      AuditAcceptSecContext,
+			Principal:  username,
+			RemoteAddr: c.remoteAddr,
+			Time:       start,
+			Err:        err,
+		})
+	}(time.Now())
+
+	if err = c.server.throttle.check("", c.remoteAddr, c.server.now()); err != nil {
+		return nil, "", false, err
+	}
+
 	var (
 		completed bool
 		output    []byte
-		err       error
 	)
 
-	if s.ctx == nil {
-		s.ctx, completed, output, err = kerberos.NewServerContext(s.creds, token)
+	if c.ctx == nil {
+		c.ctx, completed, output, err = kerberos.NewServerContext(c.server.creds, token)
 	} else {
-		completed, output, err = s.ctx.Update(token)
+		completed, output, err = c.ctx.Update(token)
 	}
 
 	if err != nil {
 		return nil, "", false, err
 	}
 
-	var username string
+	c.peerInfo = nil
 
 	if completed {
-		if username, err = s.ctx.GetUsername(); err != nil {
+		if username, err = c.ctx.GetUsername(); err != nil {
 			return nil, "", false, err
 		}
+
+		// Return the principal so the failure is recorded against it
+		if err = c.server.throttle.check(username, nil, c.server.now()); err != nil {
+			return nil, username, false, err
+		}
+
+		// The username is in the DOMAIN\user form
+		c.peerInfo = newPeerInfo(username)
+		c.peerInfo.EndTime = c.ctx.Expiry()
 	}
 
 	return output, username, !completed, nil
@@ -222,21 +469,93 @@ func (s *Server) AcceptSecContext(token []byte) ([]byte, string, bool, error) {
 
 // VerifyMIC is called by the ssh.ServerConn to authenticate the user using
 // the negotiated security context.
-func (s *Server) VerifyMIC(micField, micToken []byte) error {
-	_, err := s.ctx.VerifySignature(micField, micToken, 0)
+func (c *ServerContext) VerifyMIC(micField, micToken []byte) (err error) {
+	defer func(start time.Time) {
+		var principal string
+		if c.peerInfo != nil {
+			principal = c.peerInfo.Principal
+		}
+
+		c.server.audit(AuditEvent{
+			Stage:      AuditVerifyMIC,
+			Principal:  principal,
+			RemoteAddr: c.remoteAddr,
+			Time:       start,
+			Err:        err,
+		})
+	}(time.Now())
+
+	if c.ctx == nil {
+		return errNoContext
+	}
+
+	_, err = c.ctx.VerifySignature(micField, micToken, 0)
 
 	return err
 }
 
+// backendAuditReason returns the reason for an SSPI error.
+func backendAuditReason(err error) AuditReason {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ReasonOther
+	}
+
+	switch errno {
+	case secEInvalidToken:
+		return ReasonMalformedToken
+	case secEMessageAltered:
+		return ReasonBadIntegrity
+	case secEWrongPrincipal:
+		return ReasonWrongPrincipal
+	case secETimeSkew:
+		return ReasonClockSkew
+	case sspi.SEC_E_CONTEXT_EXPIRED:
+		return ReasonTicketExpired
+	}
+
+	return ReasonOther
+}
+
 // DeleteSecContext is called by the ssh.ServerConn to tear down any active
 // security context.
-func (s *Server) DeleteSecContext() error {
+func (c *ServerContext) DeleteSecContext() error {
 	var err error
 
-	if s.ctx != nil {
-		err = s.ctx.Release()
-		s.ctx = nil
+	if c.ctx != nil {
+		err = c.ctx.Release()
+		c.ctx = nil
 	}
 
 	return err
 }
+
+// DelegatedCredentials returns any credentials delegated by the client once
+// the security context has been established. This is not supported.
+func (c *ServerContext) DelegatedCredentials() (*credentials.CCache, error) {
+	return nil, errNotSupported
+}
+
+// PeerInfo returns details of the principal authenticated by the security
+// context once it has been established. Only the principal and EndTime
+// fields are populated.
+func (c *ServerContext) PeerInfo() (*PeerInfo, error) {
+	if c.peerInfo == nil {
+		return nil, errNoContext
+	}
+
+	return c.peerInfo, nil
+}
+
+// ServicePrincipal returns the service principal the client authenticated
+// against once the security context has been established. This is not
+// supported.
+func (c *ServerContext) ServicePrincipal() (string, error) {
+	return "", errNotSupported
+}
+
+// WriteDelegatedCredentials writes any credentials delegated by the client to
+// a new private file credentials cache. This is not supported.
+func (c *ServerContext) WriteDelegatedCredentials(_ string) (*CCacheFile, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,237 @@
+package sshkrb5
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// ErrThrottled is returned when a principal or remote address has failed to
+// authenticate too many times recently.
+var ErrThrottled = errors.New("too many failed authentication attempts")
+
+// ThrottleStore records the failed authentication attempts seen by a Server
+// so that further attempts can be refused.
+type ThrottleStore interface {
+	// Fail records a failed attempt for key until it expires and returns
+	// the number of unexpired failed attempts recorded for key. now is
+	// the current time according to the Server.
+	Fail(key string, now, expires time.Time) (int, error)
+	// Failures returns the number of failed attempts recorded for key
+	// that haven't expired by now.
+	Failures(key string, now time.Time) (int, error)
+	// Reset forgets all of the failed attempts recorded for key.
+	Reset(key string) error
+}
+
+// throttleSweepInterval is how often a MemoryThrottleStore removes the
+// keys that haven't been seen since their failed attempts expired.
+const throttleSweepInterval = time.Minute
+
+// MemoryThrottleStore is a ThrottleStore for a single process.
+type MemoryThrottleStore struct {
+	mu        sync.Mutex
+	entries   map[string][]time.Time
+	nextSweep time.Time
+}
+
+// NewMemoryThrottleStore returns a new MemoryThrottleStore.
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{
+		entries: make(map[string][]time.Time),
+	}
+}
+
+// expire removes any expired failed attempts for key, along with any other
+// keys whose failed attempts have all expired if a sweep is due. It must be
+// called with the lock held.
+func (s *MemoryThrottleStore) expire(key string, now time.Time) {
+	s.expireKey(key, now)
+
+	if now.Before(s.nextSweep) {
+		return
+	}
+
+	for k := range s.entries {
+		s.expireKey(k, now)
+	}
+
+	s.nextSweep = now.Add(throttleSweepInterval)
+}
+
+// expireKey removes any expired failed attempts for key, it must be called
+// with the lock held.
+func (s *MemoryThrottleStore) expireKey(key string, now time.Time) {
+	failures, ok := s.entries[key]
+	if !ok {
+		return
+	}
+
+	i := 0
+
+	for _, t := range failures {
+		if now.Before(t) {
+			failures[i] = t
+			i++
+		}
+	}
+
+	if i == 0 {
+		delete(s.entries, key)
+	} else {
+		s.entries[key] = failures[:i]
+	}
+}
+
+// Fail records a failed attempt for key until it expires.
+func (s *MemoryThrottleStore) Fail(key string, now, expires time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(key, now)
+
+	s.entries[key] = append(s.entries[key], expires)
+
+	return len(s.entries[key]), nil
+}
+
+// Failures returns the number of unexpired failed attempts for key.
+func (s *MemoryThrottleStore) Failures(key string, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(key, now)
+
+	return len(s.entries[key]), nil
+}
+
+// Reset forgets all of the failed attempts for key.
+func (s *MemoryThrottleStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+
+	return nil
+}
+
+// WithThrottling enables throttling in the Server. Once a principal or
+// remote address has failed to authenticate maxFailures times within the
+// window, further attempts are refused with ErrThrottled until enough of
+// the failures are older than the window. A successful login resets the
+// failures. Principals are throttled as soon as the ticket is decrypted.
+// Remote addresses are only throttled before the ticket is decrypted if the
+// ServerContext is created with NewContextWithRemoteAddr.
+func WithThrottling[T Server](maxFailures int, window time.Duration) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.throttle.maxFailures = maxFailures
+			x.throttle.window = window
+
+			if x.throttle.store == nil {
+				x.throttle.store = NewMemoryThrottleStore()
+			}
+		}
+
+		return nil
+	}
+}
+
+// WithThrottleStore sets the ThrottleStore in the Server used to record
+// failed attempts when throttling is enabled. The default is a
+// MemoryThrottleStore.
+func WithThrottleStore[T Server](store ThrottleStore) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Server); ok {
+			x.throttle.store = store
+		}
+
+		return nil
+	}
+}
+
+// NewContextWithRemoteAddr is the same as NewContext except the remote
+// address of the connection is known, which allows throttling it before
+// the ticket is decrypted and includes it in every AuditEvent.
+func (s *Server) NewContextWithRemoteAddr(addr net.Addr) *ServerContext {
+	c := s.NewContext()
+	c.remoteAddr = addr
+
+	return c
+}
+
+// throttle tracks failed attempts by principal and remote address.
+type throttle struct {
+	maxFailures int
+	window      time.Duration
+	store       ThrottleStore
+}
+
+func (t *throttle) enabled() bool {
+	return t.maxFailures > 0
+}
+
+// keys returns the store keys for the principal and remote address, either
+// can be unknown.
+func (t *throttle) keys(principal string, addr net.Addr) []string {
+	keys := make([]string, 0, 2)
+
+	if principal != "" {
+		keys = append(keys, "principal:"+principal)
+	}
+
+	if addr != nil {
+		// Ignore the port as it changes with every connection
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+
+		keys = append(keys, "addr:"+host)
+	}
+
+	return keys
+}
+
+// check returns ErrThrottled if either the principal or remote address have
+// failed too many times.
+func (t *throttle) check(principal string, addr net.Addr, now time.Time) error {
+	if !t.enabled() {
+		return nil
+	}
+
+	for _, key := range t.keys(principal, addr) {
+		n, err := t.store.Failures(key, now)
+		if err != nil {
+			return err
+		}
+
+		if n >= t.maxFailures {
+			return ErrThrottled
+		}
+	}
+
+	return nil
+}
+
+// fail records a failed attempt for the principal and remote address.
+func (t *throttle) fail(principal string, addr net.Addr, now time.Time) (err error) {
+	for _, key := range t.keys(principal, addr) {
+		_, failErr := t.store.Fail(key, now, now.Add(t.window))
+		err = multierror.Append(err, failErr).ErrorOrNil()
+	}
+
+	return err
+}
+
+// reset forgets the failed attempts for the principal and remote address.
+func (t *throttle) reset(principal string, addr net.Addr) (err error) {
+	for _, key := range t.keys(principal, addr) {
+		err = multierror.Append(err, t.store.Reset(key)).ErrorOrNil()
+	}
+
+	return err
+}